@@ -1,47 +1,43 @@
 package fspdriver
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
 
+const (
+	logFlags = log.Ldate | log.Ltime | log.Lmicroseconds | log.Lmsgprefix | log.Lshortfile
+)
+
 var (
-    WARNINGLogger *log.Logger
-    INFOLogger    *log.Logger
-    ERRORLogger   *log.Logger
-	DEBUGLogger   *log.Logger
+	WARNINGLogger *log.Logger = log.New(os.Stderr, "WARNING ", logFlags)
+	INFOLogger    *log.Logger = log.New(os.Stderr, "INFO ", logFlags)
+	ERRORLogger   *log.Logger = log.New(os.Stderr, "ERROR ", logFlags)
+	DEBUGLogger   *log.Logger = log.New(os.Stderr, "DEBUG ", logFlags)
 )
 
 var (
-	LOG_LEVEL = 20  // default log level
-	DEBUG_LEVEL = 10
-	INFO_LEVEL = 20
+	LOG_LEVEL     = 20 // default log level
+	DEBUG_LEVEL   = 10
+	INFO_LEVEL    = 20
 	WARNING_LEVEL = 30
-	ERROR_LEVEL = 40	
+	ERROR_LEVEL   = 40
 )
 
-func init() {
-
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	if logLevelStr != "" {
-		switch (logLevelStr) {
-		case "DEBUG":
-			LOG_LEVEL = 10
-		case "INFO":
-			LOG_LEVEL = 20
-		case "WARNING":
-			LOG_LEVEL = 30
-		case "ERROR":
-			LOG_LEVEL = 40
-		default:
-			WARNINGLogger.Printf("Unrecognized LOG_LEVEL env variable value: %s. Keeping LOG_LEVEL at level INFO (20)", logLevelStr)
-		}
+// SetLogLevel sets LOG_LEVEL by its name: DEBUG, INFO, WARNING or ERROR
+func SetLogLevel(logLevelStr string) error {
+	switch logLevelStr {
+	case "DEBUG":
+		LOG_LEVEL = DEBUG_LEVEL
+	case "INFO":
+		LOG_LEVEL = INFO_LEVEL
+	case "WARNING":
+		LOG_LEVEL = WARNING_LEVEL
+	case "ERROR":
+		LOG_LEVEL = ERROR_LEVEL
+	default:
+		return fmt.Errorf("unrecognized LOG_LEVEL value: %s", logLevelStr)
 	}
-
-	flag := log.Ldate|log.Ltime|log.Lmicroseconds|log.Lmsgprefix|log.Lshortfile
-
-    INFOLogger = log.New(os.Stderr, "INFO ", flag)
-    WARNINGLogger = log.New(os.Stderr, "WARNING ", flag)
-    ERRORLogger = log.New(os.Stderr, "ERROR ", flag)
-	DEBUGLogger = log.New(os.Stderr, "DEBUG ", flag)
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,169 @@
+package fspdriver
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	AEC_STRATEGY_MAX         = "max"
+	AEC_STRATEGY_PERCENTILE  = "percentile"
+	AEC_STRATEGY_SPOT_MEDIAN = "spot_median"
+	AEC_STRATEGY_SATURATION  = "saturation"
+
+	// Defaults of AECOptions
+	AEC_STRATEGY            = AEC_STRATEGY_MAX
+	AEC_PERCENTILE          = 99.9
+	AEC_SATURATION_LEVEL    = 250
+	AEC_MAX_SATURATED_SPOTS = 0
+)
+
+// AECStrategy measures the exposure of the frames
+// sampled by CalibrateExposure
+type AECStrategy interface {
+	// Measure returns the exposure value of the sampled frame (CV16UC1)
+	// and the target it is to be brought to
+	Measure(mat gocv.Mat) (value int, target int, err error)
+}
+
+// AEC_STRATEGIES registers the available AECStrategy constructors by name.
+// The effective one is selected with AECOptions.Strategy.
+// grid is the last calibrated one, empty if none
+var AEC_STRATEGIES = map[string]func(options DriverOptions, layout *ChipLayout, grid []GridNode) AECStrategy{
+	// Global image max, sensitive to hot pixels and reflections
+	AEC_STRATEGY_MAX: func(options DriverOptions, layout *ChipLayout, grid []GridNode) AECStrategy {
+		return &percentileAECStrategy{percentile: 100, target: options.AEC.MaxValueTarget}
+	},
+	AEC_STRATEGY_PERCENTILE: func(options DriverOptions, layout *ChipLayout, grid []GridNode) AECStrategy {
+		return &percentileAECStrategy{percentile: options.AEC.Percentile, target: options.AEC.MaxValueTarget}
+	},
+	// Median of the spot peaks
+	AEC_STRATEGY_SPOT_MEDIAN: func(options DriverOptions, layout *ChipLayout, grid []GridNode) AECStrategy {
+		return newSpotsAECStrategy(options, layout, grid, layout.MMINodes()/2, options.AEC.MaxValueTarget)
+	},
+	// Brightest spots kept just below saturation (by the strategy tolerance), but AECOptions.MaxSaturatedSpots
+	AEC_STRATEGY_SATURATION: func(options DriverOptions, layout *ChipLayout, grid []GridNode) AECStrategy {
+		aec := options.AEC
+		target := aec.SaturationLevel - aec.StrategyOptions(AEC_STRATEGY_SATURATION).Tolerance
+		return newSpotsAECStrategy(options, layout, grid, layout.MMINodes()-1-aec.MaxSaturatedSpots, target)
+	},
+}
+
+func NewAECStrategy(options DriverOptions, layout *ChipLayout, grid []GridNode) (AECStrategy, error) {
+	newStrategy, ok := AEC_STRATEGIES[options.AEC.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown AEC strategy: %s", options.AEC.Strategy)
+	}
+	return newStrategy(options, layout, grid), nil
+}
+
+// percentileAECStrategy targets a percentile of the image pixel values
+type percentileAECStrategy struct {
+	percentile float64
+	target     int
+}
+
+func (s *percentileAECStrategy) Measure(mat gocv.Mat) (int, int, error) {
+	data, err := mat.DataPtrUint16()
+	if err != nil {
+		return 0, s.target, err
+	}
+	return percentileValue(data, s.percentile), s.target, err
+}
+
+// percentileValue returns the smallest value not exceeded
+// by percentile % of the pixels
+func percentileValue(data []uint16, percentile float64) int {
+	max := 0
+	for _, v := range data {
+		if int(v) > max {
+			max = int(v)
+		}
+	}
+	hist := make([]int, max+1)
+	for _, v := range data {
+		hist[v]++
+	}
+	rank := int(math.Ceil(percentile / 100 * float64(len(data))))
+	count := 0
+	for v := 0; v <= max; v++ {
+		count += hist[v]
+		if count >= rank {
+			return v
+		}
+	}
+	return max
+}
+
+// spotsAECStrategy targets the rank-th smallest spot peak (max pixel of
+// each MMI patch) on the grid. The grid is detected on the sampled frames
+// if not calibrated yet, the image max standing in until it is found
+type spotsAECStrategy struct {
+	nodeDetection NodeDetectionOptions
+	imagesPath    string
+	radius        int
+	layout        *ChipLayout
+
+	grid []GridNode
+
+	rank   int
+	target int
+}
+
+func newSpotsAECStrategy(options DriverOptions, layout *ChipLayout, grid []GridNode, rank, target int) *spotsAECStrategy {
+	return &spotsAECStrategy{
+		nodeDetection: options.NodeDetection,
+		imagesPath:    options.ImagesPath,
+		radius:        options.Extraction.EllipseRadius,
+		layout:        layout,
+		grid:          grid,
+		rank:          rank,
+		target:        target,
+	}
+}
+
+func (s *spotsAECStrategy) Measure(mat gocv.Mat) (int, int, error) {
+	data, err := mat.DataPtrUint16()
+	if err != nil {
+		return 0, s.target, err
+	}
+	if len(s.grid) == 0 {
+		grid, err := CalibrateSpotsGrid(mat, s.layout, s.nodeDetection, s.imagesPath, s.radius)
+		if err != nil {
+			if LOG_LEVEL <= WARNING_LEVEL {
+				WARNINGLogger.Printf("AEC: spots grid not detected, using the image max: %s", err.Error())
+			}
+			return percentileValue(data, 100), s.target, nil
+		}
+		s.grid = grid
+	}
+	peaks := spotPeaks(data, mat.Cols(), mat.Rows(), s.grid, s.radius)
+	sort.Ints(peaks)
+	return peaks[s.rank], s.target, err
+}
+
+// spotPeaks returns the max pixel value of each MMI patch
+func spotPeaks(data []uint16, w, h int, grid []GridNode, radius int) []int {
+	peaks := make([]int, len(grid))
+	for i, node := range grid {
+		nodeX := int(math.Round(node.X))
+		nodeY := int(math.Round(node.Y))
+		for y := nodeY - radius; y < nodeY+radius; y++ {
+			if y < 0 || y >= h {
+				continue
+			}
+			for x := nodeX - radius; x < nodeX+radius; x++ {
+				if x < 0 || x >= w {
+					continue
+				}
+				if v := int(data[y*w+x]); v > peaks[i] {
+					peaks[i] = v
+				}
+			}
+		}
+	}
+	return peaks
+}
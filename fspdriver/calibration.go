@@ -0,0 +1,263 @@
+package fspdriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	CALIBRATION_STEP_EXPOSURE   = "exposure"
+	CALIBRATION_STEP_DARK_FRAME = "dark_frame"
+	CALIBRATION_STEP_DARK_VALUE = "dark_value"
+	CALIBRATION_STEP_GRID       = "grid"
+	CALIBRATION_STEP_FLAT_FIELD = "flat_field"
+)
+
+// CALIBRATION_STEPS are run in this order
+var CALIBRATION_STEPS = []string{
+	CALIBRATION_STEP_EXPOSURE,
+	CALIBRATION_STEP_DARK_FRAME,
+	CALIBRATION_STEP_DARK_VALUE,
+	CALIBRATION_STEP_GRID,
+	CALIBRATION_STEP_FLAT_FIELD,
+}
+
+// CALIBRATION_DEFAULT_STEPS are run on start
+var CALIBRATION_DEFAULT_STEPS = []string{
+	CALIBRATION_STEP_EXPOSURE,
+	CALIBRATION_STEP_DARK_VALUE,
+	CALIBRATION_STEP_GRID,
+}
+
+// calibrationRequest asks the running camera pipeline to recalibrate
+type calibrationRequest struct {
+	steps map[string]bool
+	// User supplied images, by step
+	imagePaths map[string]string
+	resultChan chan error
+}
+
+// parseCalibrationSteps validates the requested steps.
+// None means CALIBRATION_DEFAULT_STEPS
+func parseCalibrationSteps(steps []string) (map[string]bool, error) {
+	parsed := map[string]bool{}
+	if len(steps) == 0 {
+		steps = CALIBRATION_DEFAULT_STEPS
+	}
+	for _, step := range steps {
+		if !containsString(CALIBRATION_STEPS, step) {
+			return parsed, fmt.Errorf("unknown calibration step: %s. Available: %v", step, CALIBRATION_STEPS)
+		}
+		parsed[step] = true
+	}
+	return parsed, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func calibrationStepsString(steps map[string]bool) string {
+	var names []string
+	for _, step := range CALIBRATION_STEPS {
+		if steps[step] {
+			names = append(names, step)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// calibrateCamera runs the calibration steps, then starts the camera with
+// the resulting calibration. The manual exposure and grid, if any, stand for the exposure and grid steps.
+// The dark frame and flat field reference are read from imagePaths, if given. Camera state follows the steps
+func (d *Driver) calibrateCamera(ctx context.Context, steps map[string]bool, imagePaths map[string]string) (FrameSource, error) {
+	var err error
+
+	if steps[CALIBRATION_STEP_EXPOSURE] && d.applyManualExposure() {
+		if LOG_LEVEL <= INFO_LEVEL {
+			calibration := d.getCalibration()
+			INFOLogger.Printf("Manual exposure, AEC bypassed. ShutterSpeed: %d, Gain: %g", calibration.EffectiveShutterSpeed, calibration.EffectiveGain)
+		}
+	} else if steps[CALIBRATION_STEP_EXPOSURE] {
+		d.setCameraState(CAMERA_STATE_CALIBRATING_EXPOSURE, "")
+		err = d.CalibrateExposure(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if LOG_LEVEL <= INFO_LEVEL {
+			calibration := d.getCalibration()
+			INFOLogger.Printf("AEC completed (%s). ShutterSpeed: %d, Value: %d, Target: %d", calibration.AECStrategy, calibration.EffectiveShutterSpeed, calibration.EffectiveMaxValue, calibration.TargetMaxValue)
+		}
+	}
+
+	calibration := d.getCalibration()
+	source, err := d.StartCamera(d.getFramerate(), calibration.EffectiveShutterSpeed, calibration.EffectiveGain)
+	if err != nil {
+		return nil, err
+	}
+	if steps[CALIBRATION_STEP_DARK_FRAME] {
+		// Light source is expected to be off
+		darkFrame, err := d.acquireLumaImage(ctx, source, imagePaths[CALIBRATION_STEP_DARK_FRAME], DARK_FRAME_SAMPLE_SIZE)
+		if err == nil {
+			err = d.setDarkFrame(darkFrame)
+		}
+		if err != nil {
+			StopCamera(source)
+			return nil, fmt.Errorf("dark frame: %w", err)
+		}
+	}
+	if steps[CALIBRATION_STEP_DARK_VALUE] || steps[CALIBRATION_STEP_GRID] {
+		d.setCameraState(CAMERA_STATE_DETECTING_GRID, "")
+		mat, err := SampleCamera(ctx, source, d.options.FrameWidth, d.options.FrameHeight)
+		defer mat.Close()
+		if err == nil {
+			// Dark value and grid are calibrated on the frame extraction works on
+			err = subtractDarkFrameMat(&mat, d.getDarkFrame())
+		}
+		if err != nil {
+			StopCamera(source)
+			return nil, err
+		}
+		if steps[CALIBRATION_STEP_GRID] {
+			spotsGrid, err := d.calibrateSpotsGrid(mat)
+			if err != nil {
+				StopCamera(source)
+				return nil, fmt.Errorf("grid: %w. It can be set manually with %s", err, CAMERA_SET_GRID_MQTT_TOPIC_PATH)
+			}
+			d.setSpotsGrid(spotsGrid)
+		}
+		if steps[CALIBRATION_STEP_DARK_VALUE] {
+			darkValue := CalibrateDarkValue(mat)
+			d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+				calibration.EffectiveDarkValue = darkValue
+			})
+		}
+	}
+	if steps[CALIBRATION_STEP_FLAT_FIELD] {
+		// Spots are expected to be equally bright, e.g. with a blank chip
+		gains, err := d.acquireFlatField(ctx, source, imagePaths[CALIBRATION_STEP_FLAT_FIELD])
+		if err == nil {
+			err = d.setFlatField(gains)
+		}
+		if err != nil {
+			StopCamera(source)
+			return nil, fmt.Errorf("flat field: %w", err)
+		}
+	}
+	if steps[CALIBRATION_STEP_EXPOSURE] || steps[CALIBRATION_STEP_GRID] {
+		// Spot level is to be taken again by the ExposureTracker
+		d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+			calibration.ReferenceSpotLevel = 0
+		})
+	}
+	return source, err
+}
+
+// recalibrateCamera is calibrateCamera on the camera stopped from running.
+// On failure, the previous calibration is restored and the camera
+// restarted with it, the returned error being the calibration one
+func (d *Driver) recalibrateCamera(ctx context.Context, steps map[string]bool, imagePaths map[string]string) (FrameSource, error) {
+	previous := d.getCalibration()
+	// The camera is stopped whatever the steps, from running or from
+	// a failure while the supervisor was restarting it
+	d.setCameraState(CAMERA_STATE_STARTING, "recalibration")
+	source, err := d.calibrateCamera(ctx, steps, imagePaths)
+	if err == nil || ctx.Err() != nil {
+		return source, err
+	}
+	if LOG_LEVEL <= ERROR_LEVEL {
+		ERRORLogger.Printf("Recalibration failed, restarting the camera with the previous calibration: %s", err.Error())
+	}
+	d.setCalibration(previous)
+	source, startErr := d.StartCamera(d.getFramerate(), previous.EffectiveShutterSpeed, previous.EffectiveGain)
+	if startErr != nil {
+		return nil, startErr
+	}
+	return source, err
+}
+
+// commandCalibration has the running camera pipeline run the calibration steps.
+// The camera is stopped meanwhile
+func (d *Driver) commandCalibration(request CalibrationRequestMessage) error {
+	parsedSteps, err := parseCalibrationSteps(request.Steps)
+	if err != nil {
+		return err
+	}
+	if state := d.getCameraState(); state != CAMERA_STATE_RUNNING {
+		return fmt.Errorf("camera is %s, calibration can only be performed while running", state.String())
+	}
+	if parsedSteps[CALIBRATION_STEP_EXPOSURE] && d.getManualExposure().Manual {
+		return fmt.Errorf("exposure is set manually, release it with %s first", CAMERA_SET_EXPOSURE_MQTT_TOPIC_PATH)
+	}
+	if parsedSteps[CALIBRATION_STEP_GRID] && d.getSpotsGrid().Source == GRID_SOURCE_MANUAL {
+		return fmt.Errorf("grid is set manually, release it with %s first", CAMERA_SET_GRID_MQTT_TOPIC_PATH)
+	}
+	source, err := NewFrameSource(d.options.FrameSource, d.options)
+	if err != nil {
+		return err
+	}
+	if _, ok := source.(CalibratedSource); ok {
+		return fmt.Errorf("frame source %s carries its own calibration", d.options.FrameSource)
+	}
+
+	d.pipelineMut.Lock()
+	pipelineDone := d.pipelineDone
+	d.pipelineMut.Unlock()
+
+	req := calibrationRequest{
+		steps: parsedSteps,
+		imagePaths: map[string]string{
+			CALIBRATION_STEP_DARK_FRAME: request.DarkFramePath,
+			CALIBRATION_STEP_FLAT_FIELD: request.FlatFieldPath,
+		},
+		resultChan: make(chan error, 1),
+	}
+	select {
+	case d.calibrationRequestChan <- req:
+	case <-pipelineDone:
+		return fmt.Errorf("camera is %s", d.getCameraState().String())
+	}
+	select {
+	case err = <-req.resultChan:
+	case <-pipelineDone:
+		err = fmt.Errorf("camera is %s", d.getCameraState().String())
+	}
+	if err == nil && LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Calibration performed: %s", calibrationStepsString(parsedSteps))
+	}
+	return err
+}
+
+func (d *Driver) PerformCalibrationHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_PERFORM_CALIBRATION_CB_MQTT_TOPIC_PATH)
+
+	payload := msg.Payload()
+	var request CalibrationRequestMessage
+	err = json.Unmarshal(payload, &request)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in PerformCalibrationHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
+		}
+	}
+	d.submitCommand(command{
+		name:      fmt.Sprintf("PERFORM_CALIBRATION=%v", request.Steps),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err == nil {
+				err = d.commandCalibration(request)
+			}
+			return d.getCalibration(), err
+		},
+	})
+}
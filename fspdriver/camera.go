@@ -1,19 +1,15 @@
 package fspdriver
 
 import (
-	"bufio"
-	"fmt"
-	"io"
+	"context"
 	"math"
-	"os"
-	"os/exec"
-	"strconv"
 
 	"gocv.io/x/gocv"
 )
 
 const ()
 
+// Default frame size, see DriverOptions
 const (
 	CAMERA_FRAME_WIDTH  = 640
 	CAMERA_FRAME_HEIGHT = 480
@@ -23,6 +19,7 @@ const (
 	CAMERA_SAMPLE_PURGE_SIZE = 3
 	CAMERA_SAMPLE_SIZE       = 3
 
+	// Defaults of AECOptions
 	AEC_UPPER_BOUNDARY      = 3000
 	AEC_LOWER_BOUNDARY      = 100
 	AEC_MAX_VALUE_TARGET    = 150
@@ -30,34 +27,18 @@ const (
 	AEC_MAX_NB_TRIALS       = 5
 )
 
-var (
-	AEC_EFFECTIVE_MAX_VALUE          = 0
-	AEC_EFFECTIVE_SHUTTER_SPEED      = 0
-	AEC_EFFECTIVE_DARK_VALUE    byte = 0
-)
-
-var (
-	CAMERA_STATE_MUT             CameraState = 0
-	CAMERA_FRAMERATE_MUT                     = 10
-	MZI_EXTRACTION_FRAMERATE_MUT             = 3
-)
-
-func init() {
-	if cameraFramerate := os.Getenv("CAMERA_FRAMERATE"); cameraFramerate != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Println("Setting CAMERA_FRAMERATE value provided in CAMERA_FRAMERATE env variable: ", CAMERA_FRAMERATE_MUT)
-		}
-		CAMERA_FRAMERATE_MUT, _ = strconv.Atoi(cameraFramerate)
-	}
-}
-
-func startCameraAndSampleMaxValue(cameraShutter int) (int, error) {
+// startCameraAndMeasure samples the camera at cameraShutter and
+// returns the exposure value measured by strategy along with its target
+func (d *Driver) startCameraAndMeasure(ctx context.Context, cameraShutter int, strategy AECStrategy) (int, int, error) {
 	var err error
-	var max int
+	var value, target int
 
-	cmd, out := StartCamera(30, cameraShutter)
+	source, err := d.StartCamera(30, cameraShutter, EXPOSURE_DEFAULT_GAIN)
+	if err != nil {
+		return value, target, err
+	}
 	defer func() {
-		err = StopCamera(cmd)
+		err = StopCamera(source)
 		if err != nil {
 			if LOG_LEVEL <= ERROR_LEVEL {
 				ERRORLogger.Println(err)
@@ -65,112 +46,134 @@ func startCameraAndSampleMaxValue(cameraShutter int) (int, error) {
 		}
 	}()
 
-	mat, err := SampleCamera(out)
+	mat, err := SampleCamera(ctx, source, d.options.FrameWidth, d.options.FrameHeight)
 	if err != nil {
-		return max, err
+		mat.Close()
+		return value, target, err
 	}
-	_, maxF, _, _ := gocv.MinMaxIdx(mat)
-	max = int(maxF)
+	value, target, err = strategy.Measure(mat)
 	mat.Close()
-	return max, err
+	return value, target, err
 }
 
-// CalibrateExposure performs a binary search on camera
-// image maxValue target CAMERA_IMAGE_MAX_VALUE_TARGET
-// with tolerance of CAMERA_IMAGE_MAX_VALUE_TOLERANCE
-func CalibrateExposure() error {
-	initialParameter := AEC_EFFECTIVE_SHUTTER_SPEED
+// CalibrateExposure performs a binary search on the shutter speed for
+// the value measured by the AECOptions.Strategy to reach its target
+// with the tolerance and trials of the strategy (AECOptions.StrategyOptions), at EXPOSURE_DEFAULT_GAIN.
+// Returns ctx.Err() once ctx is cancelled
+func (d *Driver) CalibrateExposure(ctx context.Context) error {
+	aec := d.options.AEC
+	strategy, err := NewAECStrategy(d.options, d.layout, d.getCalibration().EffectiveGrid)
+	if err != nil {
+		return err
+	}
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.EffectiveGain = EXPOSURE_DEFAULT_GAIN
+		calibration.AECStrategy = aec.Strategy
+	})
+	initialParameter := d.getCalibration().EffectiveShutterSpeed
 	if initialParameter == 0 {
-		initialParameter = (AEC_LOWER_BOUNDARY + AEC_UPPER_BOUNDARY) / 2
+		initialParameter = (aec.LowerBoundary + aec.UpperBoundary) / 2
 	}
-	_, err := exposureBinarySearch(AEC_LOWER_BOUNDARY, initialParameter, AEC_UPPER_BOUNDARY, 0)
+	_, err = d.exposureBinarySearch(ctx, strategy, aec.LowerBoundary, initialParameter, aec.UpperBoundary, 0)
 	return err
 }
 
-func exposureBinarySearch(lowerBoundary, parameter, upperBoundary, i int) (int, error) {
+func (d *Driver) exposureBinarySearch(ctx context.Context, strategy AECStrategy, lowerBoundary, parameter, upperBoundary, i int) (int, error) {
 	var err error
 
-	if i > AEC_MAX_NB_TRIALS {
+	if ctx.Err() != nil {
+		return parameter, ctx.Err()
+	}
+
+	aec := d.options.AEC.StrategyOptions(d.options.AEC.Strategy)
+	if i > aec.MaxNbTrials {
 		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Printf("ExposureCalibration: reached AEC_MAX_TRIES. ShutterSpeed: %d. MaxValue: %d", AEC_EFFECTIVE_SHUTTER_SPEED, AEC_EFFECTIVE_MAX_VALUE)
+			calibration := d.getCalibration()
+			WARNINGLogger.Printf("ExposureCalibration: reached AEC_MAX_TRIES. ShutterSpeed: %d. MaxValue: %d", calibration.EffectiveShutterSpeed, calibration.EffectiveMaxValue)
 		}
 		return parameter, err
 	}
 
-	value, err := startCameraAndSampleMaxValue(parameter)
+	value, target, err := d.startCameraAndMeasure(ctx, parameter, strategy)
 	if err != nil {
 		return parameter, err
 	}
 
-	AEC_EFFECTIVE_MAX_VALUE = value
-	AEC_EFFECTIVE_SHUTTER_SPEED = parameter
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.TargetMaxValue = target
+		calibration.EffectiveMaxValue = value
+		calibration.EffectiveShutterSpeed = parameter
+	})
 
-	diff := math.Abs(float64(AEC_MAX_VALUE_TARGET - value))
+	diff := math.Abs(float64(target - value))
 
 	if LOG_LEVEL <= DEBUG_LEVEL {
 		DEBUGLogger.Printf("ExposureCalibration: parameter: %d, value: %d; diff: %.0f", parameter, value, diff)
 	}
 
-	if diff < AEC_MAX_VALUE_TOLERANCE {
+	if diff < float64(aec.Tolerance) {
 		return parameter, err
 	}
 	newParameter := (lowerBoundary + upperBoundary) / 2
-	if value < AEC_MAX_VALUE_TARGET {
-		return exposureBinarySearch(parameter, newParameter, upperBoundary, i+1)
+	if value < target {
+		return d.exposureBinarySearch(ctx, strategy, parameter, newParameter, upperBoundary, i+1)
 	} else {
-		return exposureBinarySearch(lowerBoundary, newParameter, parameter, i+1)
+		return d.exposureBinarySearch(ctx, strategy, lowerBoundary, newParameter, parameter, i+1)
 	}
 }
 
-func StartCamera(cameraFramerate, cameraShutter int) (*exec.Cmd, io.ReadCloser) {
-	cmd := exec.Command(
-		"libcamera-raw",
-		"--camera", "0",
-		"--width", fmt.Sprint(CAMERA_FRAME_WIDTH),
-		"--height", fmt.Sprint(CAMERA_FRAME_HEIGHT),
-		"--framerate", fmt.Sprint(cameraFramerate),
-		"--flush", "1",
-		"-t", "0",
-		"--shutter", fmt.Sprint(cameraShutter),
-		"--gain", "1",
-		"--ev", "0",
-		"--denoise", "off",
-		"--contrast", "1",
-		"-o", "-",
-	)
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		ERRORLogger.Fatal(err)
-	}
-	err = cmd.Start()
+// StartCamera instantiates the frame source selected in the driver options
+// and opens it with given framerate, shutter speed and analogue gain.
+// Gain defaults to EXPOSURE_DEFAULT_GAIN
+func (d *Driver) StartCamera(cameraFramerate, cameraShutter int, cameraGain float64) (FrameSource, error) {
+	source, err := NewFrameSource(d.options.FrameSource, d.options)
 	if err != nil {
-		ERRORLogger.Fatal(err)
-	}
-	CAMERA_STATE_MUT = 1
-	return cmd, out
+		return source, err
+	}
+	if cameraGain <= 0 {
+		cameraGain = EXPOSURE_DEFAULT_GAIN
+	}
+	err = source.Open(CameraSettings{
+		Width:        d.options.FrameWidth,
+		Height:       d.options.FrameHeight,
+		Framerate:    cameraFramerate,
+		ShutterSpeed: cameraShutter,
+		Gain:         cameraGain,
+	})
+	return source, err
 }
 
-func SampleCamera(out io.ReadCloser) (gocv.Mat, error) {
-	var err error
-
-	w := CAMERA_FRAME_WIDTH
-	h := CAMERA_FRAME_HEIGHT
+// SampleCamera averages CAMERA_SAMPLE_SIZE frames of w x h pixels of the source.
+// Cancelling ctx closes the source
+func SampleCamera(ctx context.Context, source FrameSource, w, h int) (gocv.Mat, error) {
+	return SampleCameraN(ctx, source, w, h, CAMERA_SAMPLE_SIZE)
+}
 
-	r := bufio.NewReader(out)
-	buf := make([]byte, w*h+w*h/2)
+// SampleCameraN is SampleCamera averaging n frames
+func SampleCameraN(ctx context.Context, source FrameSource, w, h, n int) (gocv.Mat, error) {
+	var err error
 
 	masterMat := gocv.Zeros(h, w, gocv.MatTypeCV16UC1)
 
+	stopWatching := closeOnCancel(ctx, source)
+	defer stopWatching()
+
 	// Purge buffer for CAMERA_SAMPLE_PURGE_SIZE frames
 	for i := 0; i < CAMERA_SAMPLE_PURGE_SIZE; i++ {
-		_, err := io.ReadFull(r, buf)
+		_, _, err := source.NextFrame()
+		if ctx.Err() != nil {
+			return masterMat, ctx.Err()
+		}
 		if err != nil {
 			return masterMat, err
 		}
 	}
-	// Accumulate CAMERA_SAMPLE_SIZE frames
-	for i := 0; i < CAMERA_SAMPLE_SIZE; i++ {
-		_, err := io.ReadFull(r, buf)
+	// Accumulate n frames
+	for i := 0; i < n; i++ {
+		buf, _, err := source.NextFrame()
+		if ctx.Err() != nil {
+			return masterMat, ctx.Err()
+		}
 		if err != nil {
 			return masterMat, err
 		}
@@ -182,8 +185,8 @@ func SampleCamera(out io.ReadCloser) (gocv.Mat, error) {
 		gocv.Add(mat, masterMat, &masterMat)
 		mat.Close()
 	}
-	// Divide by CAMERA_SAMPLE_SIZE and convert back to 8U
-	masterMat.DivideUChar(CAMERA_SAMPLE_SIZE)
+	// Divide by n and convert back to 8U
+	masterMat.DivideUChar(uint8(n))
 	return masterMat, err
 }
 
@@ -200,34 +203,29 @@ func CalibrateDarkValue(mat gocv.Mat) byte {
 	}
 	darkValue = byte(maxLoc.Y)
 
-	AEC_EFFECTIVE_DARK_VALUE = darkValue
-
 	return darkValue
 }
 
-func StopCamera(cmd *exec.Cmd) error {
-	var err error
-	if LOG_LEVEL <= DEBUG_LEVEL {
-		DEBUGLogger.Println("Killing camera..")
-	}
-	err = cmd.Process.Kill()
-	if err != nil {
-		if LOG_LEVEL <= ERROR_LEVEL {
-			ERRORLogger.Println(err)
-		}
-	}
-	if LOG_LEVEL <= DEBUG_LEVEL {
-		DEBUGLogger.Println("Waiting camera..")
-	}
-	state, err := cmd.Process.Wait()
-	if err != nil {
-		if LOG_LEVEL <= DEBUG_LEVEL {
-			DEBUGLogger.Println(err)
+func StopCamera(source FrameSource) error {
+	return source.Close()
+}
+
+// closeOnCancel closes the source once ctx is cancelled, unblocking
+// a pending NextFrame. The returned func stops watching ctx,
+// after which the source can be closed again safely
+func closeOnCancel(ctx context.Context, source FrameSource) func() {
+	doneChan := make(chan bool)
+	exitedChan := make(chan bool)
+	go func() {
+		defer close(exitedChan)
+		select {
+		case <-ctx.Done():
+			StopCamera(source)
+		case <-doneChan:
 		}
+	}()
+	return func() {
+		close(doneChan)
+		<-exitedChan
 	}
-	if LOG_LEVEL <= DEBUG_LEVEL {
-		DEBUGLogger.Println("Camera state after killing and waiting: ", state.String())
-	}
-	CAMERA_STATE_MUT = 0
-	return err
 }
@@ -0,0 +1,131 @@
+package fspdriver
+
+import (
+	"fmt"
+	"time"
+)
+
+// Camera lifecycle states. OFF and RUNNING keep
+// their historical 0/1 values for the SET_STATE command
+const (
+	CAMERA_STATE_OFF                  CameraState = 0
+	CAMERA_STATE_RUNNING              CameraState = 1
+	CAMERA_STATE_STARTING             CameraState = 2
+	CAMERA_STATE_CALIBRATING_EXPOSURE CameraState = 3
+	CAMERA_STATE_DETECTING_GRID       CameraState = 4
+	CAMERA_STATE_STOPPING             CameraState = 5
+	CAMERA_STATE_ERROR                CameraState = 6
+)
+
+const (
+	CAMERA_STATE_STOP_TIMEOUT = 30 * time.Second
+)
+
+var cameraStateNames = map[CameraState]string{
+	CAMERA_STATE_OFF:                  "off",
+	CAMERA_STATE_RUNNING:              "running",
+	CAMERA_STATE_STARTING:             "starting",
+	CAMERA_STATE_CALIBRATING_EXPOSURE: "calibrating-exposure",
+	CAMERA_STATE_DETECTING_GRID:       "detecting-grid",
+	CAMERA_STATE_STOPPING:             "stopping",
+	CAMERA_STATE_ERROR:                "error",
+}
+
+// CAMERA_STATE_TRANSITIONS lists the states reachable from each state
+var CAMERA_STATE_TRANSITIONS = map[CameraState][]CameraState{
+	CAMERA_STATE_OFF:                  {CAMERA_STATE_STARTING},
+	CAMERA_STATE_STARTING:             {CAMERA_STATE_CALIBRATING_EXPOSURE, CAMERA_STATE_DETECTING_GRID, CAMERA_STATE_RUNNING, CAMERA_STATE_STOPPING, CAMERA_STATE_ERROR},
+	CAMERA_STATE_CALIBRATING_EXPOSURE: {CAMERA_STATE_DETECTING_GRID, CAMERA_STATE_RUNNING, CAMERA_STATE_STOPPING, CAMERA_STATE_ERROR},
+	CAMERA_STATE_DETECTING_GRID:       {CAMERA_STATE_RUNNING, CAMERA_STATE_STOPPING, CAMERA_STATE_ERROR},
+	CAMERA_STATE_RUNNING:              {CAMERA_STATE_STARTING, CAMERA_STATE_CALIBRATING_EXPOSURE, CAMERA_STATE_DETECTING_GRID, CAMERA_STATE_STOPPING, CAMERA_STATE_ERROR},
+	CAMERA_STATE_STOPPING:             {CAMERA_STATE_OFF, CAMERA_STATE_ERROR},
+	CAMERA_STATE_ERROR:                {CAMERA_STATE_STARTING, CAMERA_STATE_STOPPING, CAMERA_STATE_OFF},
+}
+
+func (s CameraState) String() string {
+	if name, ok := cameraStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(s))
+}
+
+func (d *Driver) getCameraState() CameraState {
+	d.stateMut.Lock()
+	defer d.stateMut.Unlock()
+	return d.state
+}
+
+func (d *Driver) getCameraStateMessage() CameraStateMessage {
+	d.stateMut.Lock()
+	defer d.stateMut.Unlock()
+	return CameraStateMessage{
+		State:  d.state,
+		Name:   d.state.String(),
+		Reason: d.stateReason,
+	}
+}
+
+// transitionCameraState moves the camera to the state "to" if it is reachable
+// from the current state, and publishes the new state (retained).
+// Reason describes the cause, e.g. the error leading to CAMERA_STATE_ERROR
+func (d *Driver) transitionCameraState(to CameraState, reason string) error {
+	return d.transitionCameraStateFrom(nil, to, reason)
+}
+
+// transitionCameraStateFrom is transitionCameraState restricted to the "from" states
+func (d *Driver) transitionCameraStateFrom(from []CameraState, to CameraState, reason string) error {
+	var err error
+
+	d.stateMut.Lock()
+	current := d.state
+	if from != nil && !containsCameraState(from, current) {
+		d.stateMut.Unlock()
+		return fmt.Errorf("camera is %s", current.String())
+	}
+	if !containsCameraState(CAMERA_STATE_TRANSITIONS[current], to) {
+		d.stateMut.Unlock()
+		return fmt.Errorf("illegal camera state transition: %s -> %s", current.String(), to.String())
+	}
+	d.state = to
+	d.stateReason = reason
+	msg := CameraStateMessage{
+		State:  to,
+		Name:   to.String(),
+		Reason: reason,
+	}
+
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Camera state: %s -> %s %s", current.String(), to.String(), reason)
+	}
+
+	// Publish while holding the lock for the retained state
+	// to follow the order of the transitions
+	err = PublishRetainedJsonMsg(d.getFullTopicString(CAMERA_STATE_MQTT_TOPIC_PATH), msg, d.client)
+	d.stateMut.Unlock()
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing camera state: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// setCameraState is used by the pipeline itself,
+// for which an illegal transition is a programming error worth logging
+func (d *Driver) setCameraState(to CameraState, reason string) {
+	err := d.transitionCameraState(to, reason)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Println(err)
+		}
+	}
+}
+
+func containsCameraState(states []CameraState, state CameraState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
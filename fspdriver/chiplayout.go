@@ -0,0 +1,212 @@
+package fspdriver
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Default of DriverOptions.ChipLayout
+	CHIP_LAYOUT = "seone-64"
+	// Supported version of the layout files
+	CHIP_LAYOUT_VERSION = 1
+
+	// Rows occupied by the columns: all of them, or alternating
+	// between the columns, the first one occupying the odd (even) rows
+	CHIP_LAYOUT_INTERLACE_NONE = "none"
+	CHIP_LAYOUT_INTERLACE_ODD  = "odd"
+	CHIP_LAYOUT_INTERLACE_EVEN = "even"
+
+	// Physical order of the MMIs of a MZI, as listed
+	MZI_ORDER_ABC = "abc"
+	MZI_ORDER_CBA = "cba"
+)
+
+// Built-in layouts, by file name without extension
+//
+//go:embed layouts/*.yaml
+var CHIP_LAYOUTS embed.FS
+
+// ChipLayout describes the MMI spots grid of a chip design
+// and the MMIs each MZI is made of.
+// JSON being a subset of YAML, layout files can be written in either
+type ChipLayout struct {
+	Version   int         `yaml:"version"`
+	Name      string      `yaml:"name"`
+	Rows      int         `yaml:"rows"`
+	Cols      int         `yaml:"cols"`
+	Interlace string      `yaml:"interlace"`
+	MZIs      []MZILayout `yaml:"mzis"`
+
+	// Derived by Validate.
+	// Row/Col of each MMI, by grid (flat) index: col-major, rows ascending
+	Nodes []GridNode `yaml:"-"`
+	// Grid indices of the c, b, a MMIs of each MZI
+	MZIMMIIndices [][3]int `yaml:"-"`
+
+	nodeIndices map[[2]int]int
+	mmiMZIs     []int
+}
+
+type MZILayout struct {
+	// e.g. "P0"
+	Label string `yaml:"label"`
+	// MZI_ORDER_ABC or MZI_ORDER_CBA
+	Order string `yaml:"order"`
+	// [row, col] of the MMIs, in physical order (rows ascending)
+	MMIs [3][2]int `yaml:"mmis"`
+}
+
+// LoadChipLayout reads and validates a built-in layout by name,
+// or a layout file (.yaml, .yml or .json) by path
+func LoadChipLayout(nameOrPath string) (*ChipLayout, error) {
+	var content []byte
+	var err error
+
+	ext := filepath.Ext(nameOrPath)
+	if ext == ".yaml" || ext == ".yml" || ext == ".json" {
+		content, err = os.ReadFile(nameOrPath)
+	} else {
+		content, err = CHIP_LAYOUTS.ReadFile("layouts/" + nameOrPath + ".yaml")
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("unknown chip layout: %s. Available: %v", nameOrPath, chipLayoutNames())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var layout ChipLayout
+	err = yaml.Unmarshal(content, &layout)
+	if err != nil {
+		return nil, fmt.Errorf("chip layout %s: %w", nameOrPath, err)
+	}
+	err = layout.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("chip layout %s: %w", nameOrPath, err)
+	}
+	return &layout, nil
+}
+
+func chipLayoutNames() []string {
+	var names []string
+	entries, _ := CHIP_LAYOUTS.ReadDir("layouts")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rowOccupied tells whether the column has a MMI on the row
+func (l *ChipLayout) rowOccupied(row, col int) bool {
+	switch l.Interlace {
+	case CHIP_LAYOUT_INTERLACE_ODD:
+		return (row+col)%2 == 1
+	case CHIP_LAYOUT_INTERLACE_EVEN:
+		return (row+col)%2 == 0
+	default:
+		return true
+	}
+}
+
+// Validate checks the layout and derives the grid nodes and MZI indices
+func (l *ChipLayout) Validate() error {
+	if l.Version != CHIP_LAYOUT_VERSION {
+		return fmt.Errorf("unsupported version: %d, expected %d", l.Version, CHIP_LAYOUT_VERSION)
+	}
+	if l.Rows <= 0 || l.Cols <= 0 {
+		return fmt.Errorf("invalid size: %d rows, %d cols", l.Rows, l.Cols)
+	}
+	if l.Interlace == "" {
+		l.Interlace = CHIP_LAYOUT_INTERLACE_NONE
+	}
+	if l.Interlace != CHIP_LAYOUT_INTERLACE_NONE && l.Interlace != CHIP_LAYOUT_INTERLACE_ODD && l.Interlace != CHIP_LAYOUT_INTERLACE_EVEN {
+		return fmt.Errorf("invalid interlace: %s. Must be one of %s, %s, %s", l.Interlace, CHIP_LAYOUT_INTERLACE_NONE, CHIP_LAYOUT_INTERLACE_ODD, CHIP_LAYOUT_INTERLACE_EVEN)
+	}
+	if len(l.MZIs) == 0 {
+		return fmt.Errorf("no MZIs")
+	}
+
+	l.Nodes = nil
+	l.nodeIndices = map[[2]int]int{}
+	for col := 0; col < l.Cols; col++ {
+		for row := 0; row < l.Rows; row++ {
+			if !l.rowOccupied(row, col) {
+				continue
+			}
+			l.nodeIndices[[2]int{row, col}] = len(l.Nodes)
+			l.Nodes = append(l.Nodes, GridNode{Row: row, Col: col})
+		}
+	}
+
+	l.MZIMMIIndices = make([][3]int, len(l.MZIs))
+	l.mmiMZIs = make([]int, len(l.Nodes))
+	for i := range l.mmiMZIs {
+		l.mmiMZIs[i] = -1
+	}
+	labels := map[string]bool{}
+	for i, mzi := range l.MZIs {
+		if mzi.Label == "" || labels[mzi.Label] {
+			return fmt.Errorf("MZI %d: missing or duplicate label: %q", i, mzi.Label)
+		}
+		labels[mzi.Label] = true
+		if mzi.Order != MZI_ORDER_ABC && mzi.Order != MZI_ORDER_CBA {
+			return fmt.Errorf("MZI %s: invalid order: %s. Must be %s or %s", mzi.Label, mzi.Order, MZI_ORDER_ABC, MZI_ORDER_CBA)
+		}
+		var indices [3]int
+		for k, position := range mzi.MMIs {
+			idx, ok := l.nodeIndices[position]
+			if !ok {
+				return fmt.Errorf("MZI %s: no MMI at [row, col] %v", mzi.Label, position)
+			}
+			if l.mmiMZIs[idx] >= 0 {
+				return fmt.Errorf("MZI %s: MMI at %v already belongs to MZI %s", mzi.Label, position, l.MZIs[l.mmiMZIs[idx]].Label)
+			}
+			l.mmiMZIs[idx] = i
+			indices[k] = idx
+		}
+		if mzi.Order == MZI_ORDER_ABC {
+			indices[0], indices[2] = indices[2], indices[0]
+		}
+		l.MZIMMIIndices[i] = indices
+	}
+	return nil
+}
+
+// MMINodes is the number of MMI spots of the grid
+func (l *ChipLayout) MMINodes() int {
+	return len(l.Nodes)
+}
+
+func (l *ChipLayout) MZINodes() int {
+	return len(l.MZIs)
+}
+
+// NodeIndex returns the grid index of the MMI at row, col
+func (l *ChipLayout) NodeIndex(row, col int) (int, bool) {
+	idx, ok := l.nodeIndices[[2]int{row, col}]
+	return idx, ok
+}
+
+// MZIOf returns the MZI the MMI at grid index idx belongs to,
+// and its letter (a, b or c) within the MZI
+func (l *ChipLayout) MZIOf(idx int) (int, byte, bool) {
+	mzi := l.mmiMZIs[idx]
+	if mzi < 0 {
+		return mzi, 0, false
+	}
+	for k, mmiIdx := range l.MZIMMIIndices[mzi] {
+		if mmiIdx == idx {
+			return mzi, "cba"[k], true
+		}
+	}
+	return mzi, 0, false
+}
@@ -0,0 +1,166 @@
+package fspdriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// Commands received while the queue is full are rejected
+	COMMAND_QUEUE_SIZE = 16
+)
+
+// command is a control command, run by the command executor
+// one at a time, in the order of reception. The result of run
+// is published on respTopic as an MQTTResponse
+type command struct {
+	name      string
+	id        string
+	respTopic string
+	run       func() (interface{}, error)
+}
+
+// commandIdMessage is the optional part of the command payloads
+// identifying the command, echoed in the response
+type commandIdMessage struct {
+	CommandId string
+}
+
+func parseCommandId(payload []byte) string {
+	var msg commandIdMessage
+	json.Unmarshal(payload, &msg)
+	return msg.CommandId
+}
+
+// submitCommand queues cmd for the executor.
+// The command is rejected right away if the queue is full
+func (d *Driver) submitCommand(cmd command) {
+	if d.ctx.Err() != nil {
+		d.publishCommandResult(cmd, nil, fmt.Errorf("driver is stopped"))
+		return
+	}
+	select {
+	case d.commandChan <- cmd:
+		if LOG_LEVEL <= DEBUG_LEVEL {
+			DEBUGLogger.Printf("Queued command %s", cmd.name)
+		}
+	default:
+		d.publishCommandResult(cmd, nil, fmt.Errorf("command queue is full"))
+	}
+}
+
+// runCommandExecutor runs the queued commands until ctx is cancelled.
+// Commands still queued at that point are rejected
+func (d *Driver) runCommandExecutor(ctx context.Context) {
+	defer close(d.commandExecutorDone)
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case cmd := <-d.commandChan:
+					d.publishCommandResult(cmd, nil, fmt.Errorf("driver is stopped"))
+				default:
+					return
+				}
+			}
+		case cmd := <-d.commandChan:
+			if LOG_LEVEL <= INFO_LEVEL {
+				INFOLogger.Printf("Executing command %s", cmd.name)
+			}
+			message, err := cmd.run()
+			d.publishCommandResult(cmd, message, err)
+		}
+	}
+}
+
+func (d *Driver) publishCommandResult(cmd command, message interface{}, err error) {
+	respObj := MQTTResponse{
+		Message:   message,
+		CommandId: cmd.id,
+	}
+	if err != nil {
+		if LOG_LEVEL <= WARNING_LEVEL {
+			WARNINGLogger.Printf("Rejected %s: %s", cmd.name, err.Error())
+		}
+		respObj.Error = err.Error()
+	}
+	pubErr := PublishJsonMsg(cmd.respTopic, respObj, d.client)
+	if pubErr != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing the result of %s: %s", cmd.name, pubErr.Error())
+		}
+	}
+}
+
+// commandCameraState starts or stops the camera.
+// Requesting the state the camera is already in (or heading to) is not an error
+func (d *Driver) commandCameraState(state CameraState) error {
+	switch state {
+	case CAMERA_STATE_OFF:
+		return d.StopCameraPipeline()
+	case CAMERA_STATE_RUNNING:
+		return d.StartCameraPipeline()
+	default:
+		return fmt.Errorf("invalid State value for CAMERA_STATE: %d. Must be either 0 either 1", state)
+	}
+}
+
+// commandCameraFramerate restarts the camera with the new framerate if it is active
+func (d *Driver) commandCameraFramerate(framerate int) error {
+	var err error
+
+	if framerate <= 0 {
+		return fmt.Errorf("invalid framerate: %d", framerate)
+	}
+	if framerate == d.getFramerate() {
+		return err
+	}
+
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Setting CAMERA_FRAMERATE to %d", framerate)
+	}
+	return d.reconfigureCameraPipeline(func() {
+		d.mut.Lock()
+		d.framerate = framerate
+		d.mut.Unlock()
+	})
+}
+
+// reconfigureCameraPipeline applies a camera setting,
+// stopping the camera before and starting it after if it is active
+func (d *Driver) reconfigureCameraPipeline(apply func()) error {
+	d.pipelineMut.Lock()
+	active := d.pipelineActive
+	d.pipelineMut.Unlock()
+
+	if !active {
+		apply()
+		return nil
+	}
+
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Println("Restarting the camera")
+	}
+	err := d.StopCameraPipeline()
+	if err != nil {
+		return err
+	}
+	apply()
+	return d.StartCameraPipeline()
+}
+
+// commandRecording starts or stops the recording.
+// Starting the recording in progress (same or empty path) is not an error
+func (d *Driver) commandRecording(recording RecordingMessage) (RecordingMessage, error) {
+	if !recording.Recording {
+		return d.StopRecording()
+	}
+	current := d.getRecordingMessage()
+	if current.Recording && (recording.Path == "" || recording.Path == current.Path) {
+		return current, nil
+	}
+	_, err := d.StartRecording(recording.Path)
+	return d.getRecordingMessage(), err
+}
@@ -0,0 +1,605 @@
+package fspdriver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the configuration values, by increasing precedence
+const (
+	CONFIG_SOURCE_DEFAULT = "default"
+	CONFIG_SOURCE_FILE    = "file"
+	CONFIG_SOURCE_ENV     = "env"
+	CONFIG_SOURCE_FLAG    = "flag"
+	// Changed at runtime with an MQTT command
+	CONFIG_SOURCE_MQTT = "mqtt"
+)
+
+const (
+	// Prefix of the env variables overriding any config value,
+	// e.g. FSPDRIVER_AEC_MAX_VALUE_TARGET for aec.max_value_target
+	CONFIG_ENV_PREFIX = "FSPDRIVER_"
+)
+
+// CONFIG_LEGACY_ENVS maps the historical env variables to their config keys
+var CONFIG_LEGACY_ENVS = map[string]string{
+	"MQTT_SCHEME":         "mqtt.scheme",
+	"MQTT_HOST":           "mqtt.host",
+	"MQTT_PORT":           "mqtt.port",
+	"MQTT_USERNAME":       "mqtt.username",
+	"MQTT_PASSWORD":       "mqtt.password",
+	"CAMERA_FRAME_SOURCE": "frame_source",
+	"CAMERA_FRAMERATE":    "framerate",
+	"REPLAY_PATH":         "replay_path",
+	"REPLAY_SPEED":        "replay_speed",
+}
+
+// CONFIG_SECRET_KEYS are never logged nor reported
+var CONFIG_SECRET_KEYS = map[string]bool{
+	"mqtt.username": true,
+	"mqtt.password": true,
+}
+
+type MQTTOptions struct {
+	Scheme   string `yaml:"scheme"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// AECOptions parametrize the exposure calibration, see CalibrateExposure
+type AECOptions struct {
+	// One of AEC_STRATEGIES
+	Strategy          string `yaml:"strategy"`
+	LowerBoundary     int    `yaml:"lower_boundary"`
+	UpperBoundary     int    `yaml:"upper_boundary"`
+	MaxValueTarget    int    `yaml:"max_value_target"`
+	MaxValueTolerance int    `yaml:"max_value_tolerance"`
+	MaxNbTrials       int    `yaml:"max_nb_trials"`
+	// Image percentile targeted by the percentile strategy
+	Percentile float64 `yaml:"percentile"`
+	// Spots allowed to reach SaturationLevel by the saturation strategy
+	SaturationLevel   int `yaml:"saturation_level"`
+	MaxSaturatedSpots int `yaml:"max_saturated_spots"`
+	// Tolerance and trials of the strategies, by name, overriding
+	// MaxValueTolerance and MaxNbTrials, see StrategyOptions
+	Strategies map[string]AECStrategyOptions `yaml:"strategies"`
+}
+
+// AECStrategyOptions parametrize the binary search of an AEC strategy.
+// Zero values fall back to AECOptions.MaxValueTolerance and AECOptions.MaxNbTrials
+type AECStrategyOptions struct {
+	Tolerance   int `yaml:"tolerance"`
+	MaxNbTrials int `yaml:"max_nb_trials"`
+}
+
+// StrategyOptions returns the tolerance and trials of the named strategy
+func (o AECOptions) StrategyOptions(name string) AECStrategyOptions {
+	options := o.Strategies[name]
+	if options.Tolerance == 0 {
+		options.Tolerance = o.MaxValueTolerance
+	}
+	if options.MaxNbTrials == 0 {
+		options.MaxNbTrials = o.MaxNbTrials
+	}
+	return options
+}
+
+// NodeDetectionOptions parametrize the spots grid detection, see CalibrateSpotsGrid
+type NodeDetectionOptions struct {
+	MinContourArea           float64 `yaml:"min_contour_area"`
+	MaxContourArea           float64 `yaml:"max_contour_area"`
+	DilationKernelSize       int     `yaml:"dilation_kernel_size"`
+	NodeInterlaceGap         int     `yaml:"node_interlace_gap"`
+	MinimumPrimaryContours   int     `yaml:"minimum_primary_contours"`
+	CommonAngleSearchArcDeg  float64 `yaml:"common_angle_search_arc_deg"`
+	CommonAngleSearchStepDeg float64 `yaml:"common_angle_search_step_deg"`
+	// Common angle search refinement, and projection bins, see findCommonAngleRad
+	CommonAngleSearchPrecisionDeg float64 `yaml:"common_angle_search_precision_deg"`
+	CommonAngleSearchBins         int     `yaml:"common_angle_search_bins"`
+	// One of LATTICE_FITS
+	LatticeFit string `yaml:"lattice_fit"`
+	// Lattice validation, see validateFullGrid
+	MaxAngleDisagreementDeg float64 `yaml:"max_angle_disagreement_deg"`
+	MaxNodeResidual         float64 `yaml:"max_node_residual"`
+	MinMatchedFraction      float64 `yaml:"min_matched_fraction"`
+}
+
+// GridOptions configure the spots grid persistence, see gridstore.go
+type GridOptions struct {
+	// Spots grid file. Empty for spotsgrid.json in the calibration path
+	Path string `yaml:"path"`
+	// Start from the stored grid, verified and refined on the calibration frame,
+	// rather than detecting it. Detection remains the fallback
+	ReuseStored bool `yaml:"reuse_stored"`
+	// Verification thresholds, see RefineSpotsGrid
+	MaxResidual        float64 `yaml:"max_residual"`
+	MinMatchedFraction float64 `yaml:"min_matched_fraction"`
+}
+
+// ExposureTrackingOptions configure the in-run exposure control,
+// see ExposureTracker
+type ExposureTrackingOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// Relative deviation of the spot level from its reference triggering an adjustment
+	Tolerance float64 `yaml:"tolerance"`
+	// Frames the spot level is averaged on between two adjustments
+	Interval int `yaml:"interval"`
+	// Max relative shutter speed change per adjustment
+	MaxStep float64 `yaml:"max_step"`
+}
+
+// GridTrackingOptions configure the in-run grid drift correction, see GridTracker
+type GridTrackingOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// Frames between two drift estimates
+	Interval int `yaml:"interval"`
+	// Weight of a new estimate in the smoothed correction, 1 for none
+	Smoothing float64 `yaml:"smoothing"`
+	// Min share of the nodes with a spot found around for an estimate to be taken
+	MinMatchedFraction float64 `yaml:"min_matched_fraction"`
+	// Estimated shift (px) beyond which the correction is kept, recalibration being due
+	MaxDrift float64 `yaml:"max_drift"`
+}
+
+type ExtractionOptions struct {
+	// Half side of the square patch MMI values are averaged on, px
+	EllipseRadius int `yaml:"ellipse_radius"`
+	// Quality thresholds, see MMIsQuality
+	MaxSaturatedFraction float64 `yaml:"max_saturated_fraction"`
+	MinPeakContrast      int     `yaml:"min_peak_contrast"`
+	// Subtract the calibrated dark frame, if any, before extraction
+	DarkFrameSubtraction bool `yaml:"dark_frame_subtraction"`
+	// Apply the calibrated flat field gains, if any, to the MMI values
+	FlatFieldCorrection bool `yaml:"flat_field_correction"`
+}
+
+// DriverOptions holds everything a Driver is constructed from.
+// The defaults are overridden by a YAML config file (LoadConfigFile),
+// env variables (ApplyEnv) and flags, in that order.
+// The source of each value is kept track of, see ConfigValues
+type DriverOptions struct {
+	// Seone's serial number, prefixing all the MQTT topics
+	SerialNumber string      `yaml:"serial_number"`
+	MQTT         MQTTOptions `yaml:"mqtt"`
+
+	FrameSource            string `yaml:"frame_source"`
+	FrameWidth             int    `yaml:"frame_width"`
+	FrameHeight            int    `yaml:"frame_height"`
+	Framerate              int    `yaml:"framerate"`
+	MZIExtractionFramerate int    `yaml:"mzi_extraction_framerate"`
+
+	// Built-in chip layout name or layout file path, see chiplayout.go
+	ChipLayout string `yaml:"chip_layout"`
+
+	AEC              AECOptions              `yaml:"aec"`
+	ExposureTracking ExposureTrackingOptions `yaml:"exposure_tracking"`
+	NodeDetection    NodeDetectionOptions    `yaml:"node_detection"`
+	Grid             GridOptions             `yaml:"grid"`
+	GridTracking     GridTrackingOptions     `yaml:"grid_tracking"`
+	Extraction       ExtractionOptions       `yaml:"extraction"`
+
+	// Grid detection debug images directory
+	ImagesPath string `yaml:"images_path"`
+	// Persisted calibration directory (manual exposure, dark frame, ...)
+	CalibrationPath string `yaml:"calibration_path"`
+
+	SimulatorConfig SimulatorConfig `yaml:"simulator"`
+
+	RecordingsPath string `yaml:"recordings_path"`
+	RecordOnStart  bool   `yaml:"record_on_start"`
+	ReplayPath     string `yaml:"replay_path"`
+	// Replay speed relative to the recording. 0 replays as fast as possible
+	ReplaySpeed float64 `yaml:"replay_speed"`
+
+	// Config key (or key prefix) -> source of the value
+	sources map[string]string
+}
+
+func DefaultDriverOptions() DriverOptions {
+	return DriverOptions{
+		MQTT: MQTTOptions{
+			Scheme: "tcp",
+			Host:   "localhost",
+			Port:   "1883",
+		},
+		FrameSource:            FRAME_SOURCE_LIBCAMERA,
+		FrameWidth:             CAMERA_FRAME_WIDTH,
+		FrameHeight:            CAMERA_FRAME_HEIGHT,
+		Framerate:              10,
+		MZIExtractionFramerate: 3,
+		ChipLayout:             CHIP_LAYOUT,
+		AEC: AECOptions{
+			Strategy:          AEC_STRATEGY,
+			LowerBoundary:     AEC_LOWER_BOUNDARY,
+			UpperBoundary:     AEC_UPPER_BOUNDARY,
+			MaxValueTarget:    AEC_MAX_VALUE_TARGET,
+			MaxValueTolerance: AEC_MAX_VALUE_TOLERANCE,
+			MaxNbTrials:       AEC_MAX_NB_TRIALS,
+			Percentile:        AEC_PERCENTILE,
+			SaturationLevel:   AEC_SATURATION_LEVEL,
+			MaxSaturatedSpots: AEC_MAX_SATURATED_SPOTS,
+		},
+		ExposureTracking: ExposureTrackingOptions{
+			Tolerance: EXPOSURE_TRACKING_TOLERANCE,
+			Interval:  EXPOSURE_TRACKING_INTERVAL,
+			MaxStep:   EXPOSURE_TRACKING_MAX_STEP,
+		},
+		NodeDetection: NodeDetectionOptions{
+			MinContourArea:                NODE_DETECTION_MIN_CONTOUR_AREA,
+			MaxContourArea:                NODE_DETECTION_MAX_CONTOUR_AREA,
+			DilationKernelSize:            NODE_DETECTION_DILATION_KERNEL_SIZE,
+			NodeInterlaceGap:              NODE_DETECTION_NODE_INTERLACE_GAP,
+			MinimumPrimaryContours:        NODE_DETECTION_MINIMUM_PRIMARY_CONTOURS,
+			CommonAngleSearchArcDeg:       NODE_DETECTION_COMMON_ANGLE_SEARCH_ARC_DEG,
+			CommonAngleSearchStepDeg:      NODE_DETECTION_COMMON_ANGLE_SEARCH_STEP_DEG,
+			CommonAngleSearchPrecisionDeg: NODE_DETECTION_COMMON_ANGLE_SEARCH_PRECISION_DEG,
+			CommonAngleSearchBins:         NODE_DETECTION_COMMON_ANGLE_SEARCH_BINS,
+			LatticeFit:                    LATTICE_FIT,
+			MaxAngleDisagreementDeg:       NODE_DETECTION_MAX_ANGLE_DISAGREEMENT_DEG,
+			MaxNodeResidual:               NODE_DETECTION_MAX_NODE_RESIDUAL,
+			MinMatchedFraction:            NODE_DETECTION_MIN_MATCHED_FRACTION,
+		},
+		Grid: GridOptions{
+			MaxResidual:        GRID_VERIFY_MAX_RESIDUAL,
+			MinMatchedFraction: GRID_VERIFY_MIN_MATCHED_FRACTION,
+		},
+		GridTracking: GridTrackingOptions{
+			Interval:           GRID_TRACKING_INTERVAL,
+			Smoothing:          GRID_TRACKING_SMOOTHING,
+			MinMatchedFraction: GRID_TRACKING_MIN_MATCHED_FRACTION,
+			MaxDrift:           GRID_TRACKING_MAX_DRIFT,
+		},
+		Extraction: ExtractionOptions{
+			EllipseRadius:        MMI_EXTRACTION_ELLIPSE_RADIUS,
+			MaxSaturatedFraction: MMI_MAX_SATURATED_FRACTION,
+			MinPeakContrast:      MMI_MIN_PEAK_CONTRAST,
+			DarkFrameSubtraction: true,
+			FlatFieldCorrection:  true,
+		},
+		ImagesPath:      "images",
+		CalibrationPath: "calibration",
+		SimulatorConfig: DefaultSimulatorConfig(),
+		RecordingsPath:  "recordings",
+		ReplaySpeed:     1,
+	}
+}
+
+// LoadConfigFile reads a YAML config file over the default options.
+// Unknown keys and mistyped values are rejected
+func LoadConfigFile(path string) (DriverOptions, error) {
+	options := DefaultDriverOptions()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return options, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&options)
+	if err == io.EOF {
+		// Empty file
+		return options, nil
+	}
+	if err != nil {
+		return options, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	var root yaml.Node
+	err = yaml.Unmarshal(content, &root)
+	if err != nil {
+		return options, fmt.Errorf("config file %s: %w", path, err)
+	}
+	for _, field := range configFields(reflect.ValueOf(&options).Elem(), "") {
+		if yamlNodeHasPath(&root, strings.Split(field.key, ".")) {
+			options.SetSource(field.key, CONFIG_SOURCE_FILE)
+		}
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Loaded config file: %s", path)
+	}
+	return options, nil
+}
+
+// ApplyEnv overrides the options with the values provided in the env variables:
+// the historical ones (CONFIG_LEGACY_ENVS, SIMULATOR_CONFIG),
+// then CONFIG_ENV_PREFIX followed by the upper-cased config key
+func (o *DriverOptions) ApplyEnv() error {
+	var err error
+
+	for name, key := range CONFIG_LEGACY_ENVS {
+		err = o.setFromEnv(name, key)
+		if err != nil {
+			return err
+		}
+	}
+	if simulatorConfigPath := os.Getenv("SIMULATOR_CONFIG"); simulatorConfigPath != "" {
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Printf("Loading simulator config provided in SIMULATOR_CONFIG env variable: %s", simulatorConfigPath)
+		}
+		o.SimulatorConfig, err = LoadSimulatorConfig(simulatorConfigPath)
+		if err != nil {
+			return err
+		}
+		o.SetSource("simulator", CONFIG_SOURCE_ENV)
+	}
+	for _, field := range configFields(reflect.ValueOf(o).Elem(), "") {
+		name := CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(field.key, ".", "_"))
+		err = o.setFromEnv(name, field.key)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (o *DriverOptions) setFromEnv(name, key string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		if CONFIG_SECRET_KEYS[key] {
+			INFOLogger.Printf("Setting %s value provided in %s env variable: ***", key, name)
+		} else {
+			INFOLogger.Printf("Setting %s value provided in %s env variable: %s", key, name, value)
+		}
+	}
+	return o.Set(key, value, CONFIG_SOURCE_ENV)
+}
+
+// Set overrides the value of key (e.g. "aec.max_value_target").
+// Non-string values are parsed as YAML
+func (o *DriverOptions) Set(key, value, source string) error {
+	for _, field := range configFields(reflect.ValueOf(o).Elem(), "") {
+		if field.key != key {
+			continue
+		}
+		if field.value.Kind() == reflect.String {
+			field.value.SetString(value)
+		} else {
+			err := yaml.Unmarshal([]byte(value), field.value.Addr().Interface())
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+		}
+		o.SetSource(key, source)
+		return nil
+	}
+	return fmt.Errorf("unknown config key: %s", key)
+}
+
+// SetSource records where the value of key (or of all the keys under it) comes from
+func (o *DriverOptions) SetSource(key, source string) {
+	if o.sources == nil {
+		o.sources = map[string]string{}
+	}
+	for k := range o.sources {
+		if strings.HasPrefix(k, key+".") {
+			delete(o.sources, k)
+		}
+	}
+	o.sources[key] = source
+}
+
+// Source returns where the value of key comes from
+func (o DriverOptions) Source(key string) string {
+	for {
+		if source, ok := o.sources[key]; ok {
+			return source
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			return CONFIG_SOURCE_DEFAULT
+		}
+		key = key[:i]
+	}
+}
+
+// ConfigValues lists the effective values along with their source.
+// Secrets are masked
+func (o DriverOptions) ConfigValues() []ConfigValue {
+	fields := configFields(reflect.ValueOf(&o).Elem(), "")
+	values := make([]ConfigValue, 0, len(fields))
+	for _, field := range fields {
+		value := field.value.Interface()
+		if CONFIG_SECRET_KEYS[field.key] && !field.value.IsZero() {
+			value = "***"
+		}
+		values = append(values, ConfigValue{
+			Key:    field.key,
+			Value:  value,
+			Source: o.Source(field.key),
+		})
+	}
+	return values
+}
+
+func (o DriverOptions) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(o.SerialNumber != "", "serial_number: seone's serial number is not defined")
+	check(o.MQTT.Scheme != "", "mqtt.scheme is not defined")
+	check(o.MQTT.Host != "", "mqtt.host is not defined")
+	port, err := strconv.Atoi(o.MQTT.Port)
+	check(err == nil && port > 0 && port < 65536, "mqtt.port: invalid port: %s", o.MQTT.Port)
+
+	_, ok := FRAME_SOURCES[o.FrameSource]
+	check(ok, "frame_source: unknown frame source: %s", o.FrameSource)
+	check(o.FrameWidth > 0 && o.FrameWidth%2 == 0, "frame_width: must be positive and even: %d", o.FrameWidth)
+	check(o.FrameHeight > 0 && o.FrameHeight%2 == 0, "frame_height: must be positive and even: %d", o.FrameHeight)
+	check(o.Framerate > 0, "framerate: invalid framerate: %d", o.Framerate)
+	check(o.MZIExtractionFramerate > 0, "mzi_extraction_framerate: invalid framerate: %d", o.MZIExtractionFramerate)
+
+	// Node counts are bounded by the layout ones
+	var nMMIs, nMZIs int
+	layout, err := LoadChipLayout(o.ChipLayout)
+	check(err == nil, "chip_layout: %v", err)
+	if err == nil {
+		nMMIs = layout.MMINodes()
+		nMZIs = layout.MZINodes()
+	}
+
+	aec := o.AEC
+	_, ok = AEC_STRATEGIES[aec.Strategy]
+	check(ok, "aec.strategy: unknown AEC strategy: %s", aec.Strategy)
+	check(aec.LowerBoundary > 0 && aec.LowerBoundary < aec.UpperBoundary,
+		"aec: boundaries must satisfy 0 < lower_boundary < upper_boundary: %d, %d", aec.LowerBoundary, aec.UpperBoundary)
+	check(aec.MaxValueTarget > 0 && aec.MaxValueTarget < 256, "aec.max_value_target: must be within ]0, 255]: %d", aec.MaxValueTarget)
+	check(aec.MaxValueTolerance > 0, "aec.max_value_tolerance: must be positive: %d", aec.MaxValueTolerance)
+	check(aec.MaxNbTrials >= 0, "aec.max_nb_trials: must not be negative: %d", aec.MaxNbTrials)
+	check(aec.Percentile > 0 && aec.Percentile <= 100, "aec.percentile: must be within ]0, 100]: %g", aec.Percentile)
+	for name, strategy := range aec.Strategies {
+		_, ok = AEC_STRATEGIES[name]
+		check(ok, "aec.strategies: unknown AEC strategy: %s", name)
+		check(strategy.Tolerance >= 0, "aec.strategies.%s.tolerance: must not be negative: %d", name, strategy.Tolerance)
+		check(strategy.MaxNbTrials >= 0, "aec.strategies.%s.max_nb_trials: must not be negative: %d", name, strategy.MaxNbTrials)
+	}
+	saturationTolerance := aec.StrategyOptions(AEC_STRATEGY_SATURATION).Tolerance
+	check(aec.SaturationLevel > saturationTolerance && aec.SaturationLevel < 256,
+		"aec.saturation_level: must be within ]%d (saturation tolerance), 255]: %d", saturationTolerance, aec.SaturationLevel)
+	check(layout == nil || aec.MaxSaturatedSpots >= 0 && aec.MaxSaturatedSpots < nMMIs,
+		"aec.max_saturated_spots: must be within [0, %d[: %d", nMMIs, aec.MaxSaturatedSpots)
+
+	et := o.ExposureTracking
+	check(et.Tolerance > 0, "exposure_tracking.tolerance: must be positive: %g", et.Tolerance)
+	check(et.Interval > 0, "exposure_tracking.interval: must be positive: %d", et.Interval)
+	check(et.MaxStep > 0 && et.MaxStep < 1, "exposure_tracking.max_step: must be within ]0, 1[: %g", et.MaxStep)
+
+	nd := o.NodeDetection
+	check(nd.MinContourArea >= 0 && nd.MinContourArea < nd.MaxContourArea,
+		"node_detection: contour areas must satisfy 0 <= min_contour_area < max_contour_area: %g, %g", nd.MinContourArea, nd.MaxContourArea)
+	check(nd.DilationKernelSize > 0, "node_detection.dilation_kernel_size: must be positive: %d", nd.DilationKernelSize)
+	check(nd.NodeInterlaceGap > 0, "node_detection.node_interlace_gap: must be positive: %d", nd.NodeInterlaceGap)
+	check(layout == nil || nd.MinimumPrimaryContours > 0 && nd.MinimumPrimaryContours <= nMMIs,
+		"node_detection.minimum_primary_contours: must be within ]0, %d]: %d", nMMIs, nd.MinimumPrimaryContours)
+	check(nd.CommonAngleSearchStepDeg > 0 && nd.CommonAngleSearchStepDeg <= nd.CommonAngleSearchArcDeg,
+		"node_detection: angle search must satisfy 0 < common_angle_search_step_deg <= common_angle_search_arc_deg: %g, %g", nd.CommonAngleSearchStepDeg, nd.CommonAngleSearchArcDeg)
+	check(nd.CommonAngleSearchPrecisionDeg > 0 && nd.CommonAngleSearchPrecisionDeg <= nd.CommonAngleSearchStepDeg,
+		"node_detection: angle search must satisfy 0 < common_angle_search_precision_deg <= common_angle_search_step_deg: %g, %g", nd.CommonAngleSearchPrecisionDeg, nd.CommonAngleSearchStepDeg)
+	check(nd.CommonAngleSearchBins > 0, "node_detection.common_angle_search_bins: must be positive: %d", nd.CommonAngleSearchBins)
+	check(containsString(LATTICE_FITS, nd.LatticeFit), "node_detection.lattice_fit: unknown method: %s. Available: %v", nd.LatticeFit, LATTICE_FITS)
+	check(nd.MaxAngleDisagreementDeg > 0, "node_detection.max_angle_disagreement_deg: must be positive: %g", nd.MaxAngleDisagreementDeg)
+	check(nd.MaxNodeResidual > 0, "node_detection.max_node_residual: must be positive: %g", nd.MaxNodeResidual)
+	check(nd.MinMatchedFraction >= 0 && nd.MinMatchedFraction <= 1,
+		"node_detection.min_matched_fraction: must be within [0, 1]: %g", nd.MinMatchedFraction)
+
+	check(o.Grid.MaxResidual > 0, "grid.max_residual: must be positive: %g", o.Grid.MaxResidual)
+	check(o.Grid.MinMatchedFraction > 0 && o.Grid.MinMatchedFraction <= 1,
+		"grid.min_matched_fraction: must be within ]0, 1]: %g", o.Grid.MinMatchedFraction)
+
+	gt := o.GridTracking
+	check(gt.Interval > 0, "grid_tracking.interval: must be positive: %d", gt.Interval)
+	check(gt.Smoothing > 0 && gt.Smoothing <= 1, "grid_tracking.smoothing: must be within ]0, 1]: %g", gt.Smoothing)
+	check(gt.MinMatchedFraction > 0 && gt.MinMatchedFraction <= 1,
+		"grid_tracking.min_matched_fraction: must be within ]0, 1]: %g", gt.MinMatchedFraction)
+	check(gt.MaxDrift > 0, "grid_tracking.max_drift: must be positive: %g", gt.MaxDrift)
+
+	check(o.Extraction.EllipseRadius > 0, "extraction.ellipse_radius: must be positive: %d", o.Extraction.EllipseRadius)
+	check(o.Extraction.MaxSaturatedFraction >= 0 && o.Extraction.MaxSaturatedFraction < 1,
+		"extraction.max_saturated_fraction: must be within [0, 1[: %g", o.Extraction.MaxSaturatedFraction)
+	check(o.Extraction.MinPeakContrast >= 0 && o.Extraction.MinPeakContrast < 256,
+		"extraction.min_peak_contrast: must be within [0, 255]: %d", o.Extraction.MinPeakContrast)
+
+	check(o.CalibrationPath != "", "calibration_path: calibration path is not defined")
+
+	err = o.SimulatorConfig.Validate()
+	check(err == nil, "simulator: %v", err)
+	for mziIdx := range o.SimulatorConfig.Trajectories {
+		check(layout == nil || mziIdx < nMZIs, "simulator: invalid MZI index in trajectories: %d", mziIdx)
+	}
+
+	check(o.FrameSource != FRAME_SOURCE_REPLAY || o.ReplayPath != "", "replay_path: replay path is not defined")
+	check(o.ReplaySpeed >= 0, "replay_speed: must not be negative: %g", o.ReplaySpeed)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ReadSerialNumber reads seone's serial number from a text file
+func ReadSerialNumber(path string) (string, error) {
+	sn, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	snStr := strings.TrimSpace(string(sn))
+	if snStr == "" {
+		return snStr, fmt.Errorf("could not get seone's SN from %s", path)
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Setting SEONE_SN value: %s", snStr)
+	}
+	return snStr, err
+}
+
+type configField struct {
+	key   string
+	value reflect.Value
+}
+
+// configFields lists the leaf values of the struct v,
+// keyed by their dot-separated YAML path
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		if v.Field(i).Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i), key)...)
+		} else {
+			fields = append(fields, configField{key: key, value: v.Field(i)})
+		}
+	}
+	return fields
+}
+
+func yamlNodeHasPath(node *yaml.Node, path []string) bool {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return false
+		}
+		return yamlNodeHasPath(node.Content[0], path)
+	}
+	if len(path) == 0 {
+		return true
+	}
+	if node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == path[0] {
+			return yamlNodeHasPath(node.Content[i+1], path[1:])
+		}
+	}
+	return false
+}
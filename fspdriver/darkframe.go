@@ -0,0 +1,147 @@
+package fspdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// Dark frame image, in the CalibrationPath option
+	DARK_FRAME_FILE_NAME = "dark_frame.png"
+	// Frames averaged into the acquired dark frame
+	DARK_FRAME_SAMPLE_SIZE = 16
+)
+
+// LoadLumaImage reads a w x h grayscale image, e.g. a dark frame.
+// A missing file means no image
+func LoadLumaImage(path string, w, h int) ([]byte, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mat := gocv.IMRead(path, gocv.IMReadGrayScale)
+	defer mat.Close()
+	if mat.Empty() {
+		return nil, fmt.Errorf("%s: not a readable image", path)
+	}
+	if mat.Cols() != w || mat.Rows() != h {
+		return nil, fmt.Errorf("%s: size %dx%d does not match %dx%d", path, mat.Cols(), mat.Rows(), w, h)
+	}
+	return mat.ToBytes(), nil
+}
+
+func SaveLumaImage(path string, buf []byte, w, h int) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	mat, err := gocv.NewMatFromBytes(h, w, gocv.MatTypeCV8UC1, buf)
+	if err != nil {
+		return err
+	}
+	defer mat.Close()
+	if !gocv.IMWrite(path, mat) {
+		return fmt.Errorf("could not write %s", path)
+	}
+	return nil
+}
+
+// SubtractDarkFrame writes buf minus darkFrame into dst, pixel-wise, clamped at 0
+func SubtractDarkFrame(dst, buf, darkFrame []byte) {
+	for i, dark := range darkFrame {
+		if buf[i] > dark {
+			dst[i] = buf[i] - dark
+		} else {
+			dst[i] = 0
+		}
+	}
+}
+
+// subtractDarkFrameMat subtracts darkFrame from the CV16UC1 sample mat, if any
+func subtractDarkFrameMat(mat *gocv.Mat, darkFrame []byte) error {
+	if darkFrame == nil {
+		return nil
+	}
+	darkMat, err := gocv.NewMatFromBytes(mat.Rows(), mat.Cols(), gocv.MatTypeCV8UC1, darkFrame)
+	if err != nil {
+		return err
+	}
+	defer darkMat.Close()
+	darkMat.ConvertTo(&darkMat, gocv.MatTypeCV16UC1)
+	gocv.Subtract(*mat, darkMat, mat)
+	return nil
+}
+
+func (d *Driver) getDarkFramePath() string {
+	return filepath.Join(d.options.CalibrationPath, DARK_FRAME_FILE_NAME)
+}
+
+// getDarkFrame returns the calibrated dark frame to be subtracted, if any
+func (d *Driver) getDarkFrame() []byte {
+	darkFrame := d.getCalibration().DarkFrame
+	if !d.options.Extraction.DarkFrameSubtraction || len(darkFrame) != d.options.FrameWidth*d.options.FrameHeight {
+		return nil
+	}
+	return darkFrame
+}
+
+// acquireLumaImage averages n frames of the source,
+// or reads the user supplied image at path instead
+func (d *Driver) acquireLumaImage(ctx context.Context, source FrameSource, path string, n int) ([]byte, error) {
+	w := d.options.FrameWidth
+	h := d.options.FrameHeight
+	if path != "" {
+		buf, err := LoadLumaImage(path, w, h)
+		if err == nil && buf == nil {
+			err = fmt.Errorf("%s does not exist", path)
+		}
+		return buf, err
+	}
+	mat, err := SampleCameraN(ctx, source, w, h, n)
+	defer mat.Close()
+	if err != nil {
+		return nil, err
+	}
+	mat.ConvertTo(&mat, gocv.MatTypeCV8UC1)
+	return mat.ToBytes(), err
+}
+
+// setDarkFrame stores the dark frame with the calibration and persists it
+func (d *Driver) setDarkFrame(darkFrame []byte) error {
+	w := d.options.FrameWidth
+	h := d.options.FrameHeight
+	err := SaveLumaImage(d.getDarkFramePath(), darkFrame, w, h)
+	if err != nil {
+		return err
+	}
+	mean := meanValue(darkFrame)
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.DarkFrame = darkFrame
+		calibration.DarkFrameMean = mean
+		calibration.DarkFrameShutterSpeed = calibration.EffectiveShutterSpeed
+		calibration.DarkFrameGain = calibration.EffectiveGain
+	})
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Dark frame set. Mean: %.2f", mean)
+	}
+	return err
+}
+
+func meanValue(buf []byte) float64 {
+	if len(buf) == 0 {
+		return 0
+	}
+	var sum int
+	for _, v := range buf {
+		sum += int(v)
+	}
+	return float64(sum) / float64(len(buf))
+}
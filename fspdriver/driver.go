@@ -0,0 +1,208 @@
+package fspdriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Driver owns a camera, its calibration and the MQTT client
+// it is controlled through and publishes to
+type Driver struct {
+	options DriverOptions
+	client  mqtt.Client
+
+	// Cancelled by Stop, parent of the camera pipeline context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	imageTriggerChan chan bool
+
+	// Control commands, see commands.go
+	commandChan         chan command
+	commandExecutorDone chan bool
+
+	// Camera lifecycle state, see camerastate.go
+	stateMut    sync.Mutex
+	state       CameraState
+	stateReason string
+
+	pipelineMut    sync.Mutex
+	pipelineActive bool
+	pipelineCancel context.CancelFunc
+	// Closed once the pipeline goroutine returned
+	pipelineDone chan bool
+	// Received by the running pipeline, see calibration.go
+	calibrationRequestChan chan calibrationRequest
+
+	// MMI grid and MZIs of the chip, see chiplayout.go
+	layout *ChipLayout
+
+	// Effective settings and calibration
+	mut         sync.Mutex
+	framerate   int
+	calibration CameraCalibrationMessage
+	// Manual exposure, see exposure.go
+	exposure ExposureMessage
+
+	recorderMut sync.Mutex
+	recorder    *FrameRecorder
+}
+
+func NewDriver(options DriverOptions) (*Driver, error) {
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+	d := &Driver{
+		options:                options,
+		imageTriggerChan:       make(chan bool, 1),
+		commandChan:            make(chan command, COMMAND_QUEUE_SIZE),
+		calibrationRequestChan: make(chan calibrationRequest),
+		state:                  CAMERA_STATE_OFF,
+		framerate:              options.Framerate,
+		calibration: CameraCalibrationMessage{
+			TargetMaxValue: options.AEC.MaxValueTarget,
+			EffectiveGain:  EXPOSURE_DEFAULT_GAIN,
+		},
+	}
+	d.layout, err = LoadChipLayout(options.ChipLayout)
+	if err != nil {
+		return nil, err
+	}
+	d.calibration.ChipLayout = d.layout.Name
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Chip layout %s: %d MZIs, %d MMIs", d.layout.Name, d.layout.MZINodes(), d.layout.MMINodes())
+	}
+	d.exposure, err = LoadExposure(d.getExposurePath())
+	if err != nil {
+		return nil, err
+	}
+	if d.applyManualExposure() && LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Loaded manual exposure. ShutterSpeed: %d, Gain: %g", d.exposure.ShutterSpeed, d.exposure.Gain)
+	}
+	darkFrame, err := LoadLumaImage(d.getDarkFramePath(), options.FrameWidth, options.FrameHeight)
+	if err != nil {
+		return nil, err
+	}
+	if darkFrame != nil {
+		d.calibration.DarkFrame = darkFrame
+		d.calibration.DarkFrameMean = meanValue(darkFrame)
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Printf("Loaded dark frame %s. Mean: %.2f", d.getDarkFramePath(), d.calibration.DarkFrameMean)
+		}
+	}
+	flatField, err := LoadFlatField(d.getFlatFieldPath(), d.layout.MMINodes())
+	if err != nil {
+		return nil, err
+	}
+	d.calibration.FlatFieldGains = flatField.Gains
+	if flatField.Gains != nil && LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Loaded flat field %s", d.getFlatFieldPath())
+	}
+	err = d.loadStoredSpotsGrid()
+	if err != nil {
+		return nil, err
+	}
+	return d, err
+}
+
+// Start connects to the MQTT broker, subscribes to the commands
+// and starts the camera. Cancelling ctx stops the camera,
+// Stop is still to be called to disconnect from the broker
+func (d *Driver) Start(ctx context.Context) error {
+	var err error
+
+	d.ctx, d.cancel = context.WithCancel(ctx)
+
+	err = os.MkdirAll(d.options.ImagesPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	d.client, err = NewMQTTClient(d.options.MQTT, d.getFullTopicString(CAMERA_AVAILABILITY_MQTT_TOPIC_PATH))
+	if err != nil {
+		return err
+	}
+	d.publishAvailability(AVAILABILITY_ONLINE)
+
+	d.commandExecutorDone = make(chan bool)
+	go d.runCommandExecutor(d.ctx)
+
+	d.setupMQTTSubscriptionCallbacks()
+	return d.StartCameraPipeline()
+}
+
+// Stop cancels the ongoing work, waits for the camera to stop,
+// then disconnects from the MQTT broker with a last "offline" message
+func (d *Driver) Stop() error {
+	var err error
+
+	if d.cancel == nil {
+		return fmt.Errorf("driver is not started")
+	}
+	d.cancel()
+
+	if d.commandExecutorDone != nil {
+		// The command being executed returns on cancellation
+		<-d.commandExecutorDone
+	}
+
+	d.pipelineMut.Lock()
+	pipelineDone := d.pipelineDone
+	d.pipelineMut.Unlock()
+
+	if pipelineDone != nil {
+		select {
+		case <-pipelineDone:
+		case <-time.After(CAMERA_STATE_STOP_TIMEOUT):
+			err = fmt.Errorf("timeout waiting for the camera to stop, camera is %s", d.getCameraState().String())
+		}
+	}
+	if d.client == nil {
+		return err
+	}
+	d.publishAvailability(AVAILABILITY_OFFLINE)
+	d.client.Disconnect(MQTT_DISCONNECT_QUIESCE_MS)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Println("Driver stopped")
+	}
+	return err
+}
+
+func (d *Driver) publishAvailability(status string) {
+	err := PublishRetainedJsonMsg(d.getFullTopicString(CAMERA_AVAILABILITY_MQTT_TOPIC_PATH), AvailabilityMessage{Status: status}, d.client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing availability: %s", err.Error())
+		}
+	}
+}
+
+func (d *Driver) getFramerate() int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.framerate
+}
+
+func (d *Driver) getCalibration() CameraCalibrationMessage {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.calibration
+}
+
+func (d *Driver) setCalibration(calibration CameraCalibrationMessage) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.calibration = calibration
+}
+
+// updateCalibration applies f to the calibration under lock
+func (d *Driver) updateCalibration(f func(calibration *CameraCalibrationMessage)) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	f(&d.calibration)
+}
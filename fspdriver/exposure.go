@@ -0,0 +1,174 @@
+package fspdriver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Manual exposure file, in the CalibrationPath option
+	EXPOSURE_FILE_NAME = "exposure.json"
+
+	// Analogue gain AEC runs with
+	EXPOSURE_DEFAULT_GAIN = 1.0
+	EXPOSURE_MAX_GAIN     = 16.0
+)
+
+// LoadExposure reads the persisted manual exposure.
+// A missing file means automatic exposure
+func LoadExposure(path string) (ExposureMessage, error) {
+	var exposure ExposureMessage
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return exposure, nil
+	}
+	if err != nil {
+		return exposure, err
+	}
+	err = json.Unmarshal(content, &exposure)
+	if err != nil {
+		return exposure, fmt.Errorf("exposure file %s: %w", path, err)
+	}
+	return exposure, validateExposure(exposure)
+}
+
+func SaveExposure(path string, exposure ExposureMessage) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(exposure, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+func validateExposure(exposure ExposureMessage) error {
+	if !exposure.Manual {
+		return nil
+	}
+	if exposure.ShutterSpeed <= 0 {
+		return fmt.Errorf("invalid ShutterSpeed: %d", exposure.ShutterSpeed)
+	}
+	if exposure.Gain < EXPOSURE_DEFAULT_GAIN || exposure.Gain > EXPOSURE_MAX_GAIN {
+		return fmt.Errorf("invalid Gain: %g. Must be within [%g, %g]", exposure.Gain, EXPOSURE_DEFAULT_GAIN, EXPOSURE_MAX_GAIN)
+	}
+	return nil
+}
+
+func (d *Driver) getExposurePath() string {
+	return filepath.Join(d.options.CalibrationPath, EXPOSURE_FILE_NAME)
+}
+
+// getManualExposure returns the exposure pinned with /camera/exposure/set, if any
+func (d *Driver) getManualExposure() ExposureMessage {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.exposure
+}
+
+// getExposureMessage reports the effective exposure
+func (d *Driver) getExposureMessage() ExposureMessage {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return ExposureMessage{
+		Manual:       d.exposure.Manual,
+		ShutterSpeed: d.calibration.EffectiveShutterSpeed,
+		Gain:         d.calibration.EffectiveGain,
+	}
+}
+
+// applyManualExposure pins the calibrated shutter speed and gain
+// to the manual exposure, if any
+func (d *Driver) applyManualExposure() bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.calibration.ManualExposure = d.exposure.Manual
+	if !d.exposure.Manual {
+		return false
+	}
+	d.calibration.EffectiveShutterSpeed = d.exposure.ShutterSpeed
+	d.calibration.EffectiveGain = d.exposure.Gain
+	return true
+}
+
+// commandExposure pins (or releases back to AEC) the shutter speed and gain,
+// persists them and restarts the camera if it is active.
+// Gain defaults to EXPOSURE_DEFAULT_GAIN
+func (d *Driver) commandExposure(exposure ExposureMessage) (ExposureMessage, error) {
+	if exposure.Manual && exposure.Gain == 0 {
+		exposure.Gain = EXPOSURE_DEFAULT_GAIN
+	}
+	if !exposure.Manual {
+		exposure = ExposureMessage{}
+	}
+	err := validateExposure(exposure)
+	if err != nil {
+		return d.getExposureMessage(), err
+	}
+	if exposure == d.getManualExposure() {
+		return d.getExposureMessage(), err
+	}
+
+	err = SaveExposure(d.getExposurePath(), exposure)
+	if err != nil {
+		return d.getExposureMessage(), err
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Setting exposure: %+v", exposure)
+	}
+	err = d.reconfigureCameraPipeline(func() {
+		d.mut.Lock()
+		d.exposure = exposure
+		d.mut.Unlock()
+		d.applyManualExposure()
+	})
+	return d.getExposureMessage(), err
+}
+
+func (d *Driver) GetExposureHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_GET_EXPOSURE_CB_MQTT_TOPIC_PATH)
+
+	respObj := MQTTResponse{
+		Message: d.getExposureMessage(),
+	}
+	err = PublishJsonMsg(respTopic, respObj, client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in GetExposureHandler MQTT CB: %s", err.Error())
+		}
+	}
+}
+
+func (d *Driver) SetExposureHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_EXPOSURE_CB_MQTT_TOPIC_PATH)
+
+	payload := msg.Payload()
+	var exposure ExposureMessage
+	err = json.Unmarshal(payload, &exposure)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetExposureHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
+		}
+	}
+	d.submitCommand(command{
+		name:      fmt.Sprintf("SET_EXPOSURE=%+v", exposure),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err != nil {
+				return d.getExposureMessage(), err
+			}
+			return d.commandExposure(exposure)
+		},
+	})
+}
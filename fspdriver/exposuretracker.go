@@ -0,0 +1,80 @@
+package fspdriver
+
+import (
+	"math"
+)
+
+const (
+	// Defaults of ExposureTrackingOptions
+	EXPOSURE_TRACKING_TOLERANCE = 0.05
+	EXPOSURE_TRACKING_INTERVAL  = 30
+	EXPOSURE_TRACKING_MAX_STEP  = 0.1
+)
+
+// ExposureTracker keeps the spot level (brightest MMI value) at its
+// reference by adjusting the shutter speed while running, within the AEC boundaries.
+// The reference is the level averaged over the first interval, unless given
+type ExposureTracker struct {
+	options      ExposureTrackingOptions
+	lower, upper int
+
+	reference float64
+	acc       float64
+	count     int
+}
+
+func NewExposureTracker(options ExposureTrackingOptions, aec AECOptions, reference float64) *ExposureTracker {
+	return &ExposureTracker{
+		options:   options,
+		lower:     aec.LowerBoundary,
+		upper:     aec.UpperBoundary,
+		reference: reference,
+	}
+}
+
+func (t *ExposureTracker) Reference() float64 {
+	return t.reference
+}
+
+// Update accumulates the spot level of a frame acquired at shutter.
+// Returns the new shutter speed, and true once an adjustment is due
+func (t *ExposureTracker) Update(MMIs []float64, shutter int) (int, bool) {
+	var level float64
+	for _, mmi := range MMIs {
+		level = math.Max(level, mmi)
+	}
+	t.acc += level
+	t.count++
+	if t.count < t.options.Interval {
+		return shutter, false
+	}
+	mean := t.acc / float64(t.count)
+	t.acc = 0
+	t.count = 0
+
+	if mean <= 0 {
+		return shutter, false
+	}
+	if t.reference == 0 {
+		t.reference = mean
+		return shutter, false
+	}
+	if math.Abs(mean-t.reference)/t.reference <= t.options.Tolerance {
+		return shutter, false
+	}
+
+	ratio := t.reference / mean
+	ratio = math.Max(ratio, 1-t.options.MaxStep)
+	ratio = math.Min(ratio, 1+t.options.MaxStep)
+	newShutter := int(math.Round(float64(shutter) * ratio))
+	if newShutter < t.lower {
+		newShutter = t.lower
+	}
+	if newShutter > t.upper {
+		newShutter = t.upper
+	}
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Printf("ExposureTracker: level: %.1f, reference: %.1f, shutter: %d -> %d", mean, t.reference, shutter, newShutter)
+	}
+	return newShutter, newShutter != shutter
+}
@@ -8,31 +8,54 @@ import (
 )
 
 const (
+	// Defaults of ExtractionOptions
 	MMI_EXTRACTION_ELLIPSE_RADIUS int = 8
+	MMI_MAX_SATURATED_FRACTION        = 0.05
+	MMI_MIN_PEAK_CONTRAST             = 10
+
+	// Pixel value considered clipped
+	MMI_SATURATION_VALUE = 255
+)
+
+// Quality flags of the MMIs, MZIs and frames.
+// MZIs and frames carry the union of the flags of their MMIs
+const (
+	// Share of clipped pixels in a MMI patch above ExtractionOptions.MaxSaturatedFraction
+	QUALITY_SATURATED uint32 = 1 << iota
+	// MMI peak less than ExtractionOptions.MinPeakContrast above the dark value
+	QUALITY_UNDEREXPOSED
 )
 
+// MMIStats are computed alongside the MMI values
+type MMIStats struct {
+	Peak              byte
+	SaturatedFraction float64
+}
+
 // ExtractMMIsInefficient extracts luminence values out according to the grid.
 // Value is defined as mean of all non-zero pixels inside the
-// square patch with side size of MMI_EXTRACTION_ELLIPSE_RADIUS
+// square patch with half side size of radius, nodes rounded to the pixel
 // TODO: should be a circular patch, not square one
-func ExtractMMIsInefficient(mat gocv.Mat, grid [MMI_N_NODES]GridNode) [MMI_N_NODES]float64 {
-	var MMIs [MMI_N_NODES]float64
+func ExtractMMIsInefficient(mat gocv.Mat, grid []GridNode, radius int) []float64 {
+	MMIs := make([]float64, len(grid))
 
 	for i, node := range grid {
+		nodeX := int(math.Round(node.X))
+		nodeY := int(math.Round(node.Y))
 
-		x0 := node.X - MMI_EXTRACTION_ELLIPSE_RADIUS
+		x0 := nodeX - radius
 		if x0 < 0 {
 			x0 = 0
 		}
-		y0 := node.Y - MMI_EXTRACTION_ELLIPSE_RADIUS
+		y0 := nodeY - radius
 		if y0 < 0 {
 			y0 = 0
 		}
-		x1 := node.X + MMI_EXTRACTION_ELLIPSE_RADIUS
+		x1 := nodeX + radius
 		if x1 >= mat.Cols() {
 			x1 = mat.Cols() - 1
 		}
-		y1 := node.Y + MMI_EXTRACTION_ELLIPSE_RADIUS
+		y1 := nodeY + radius
 		if y1 >= mat.Rows() {
 			y1 = mat.Rows() - 1
 		}
@@ -56,62 +79,129 @@ func ExtractMMIsInefficient(mat gocv.Mat, grid [MMI_N_NODES]GridNode) [MMI_N_NOD
 	return MMIs
 }
 
-func ExtractMMIsBuffer(buf []byte, grid [MMI_N_NODES]GridNode, darkValue byte) [MMI_N_NODES]float64 {
-	var MMIs [MMI_N_NODES]float64
+// ExtractMMIsBuffer is ExtractMMIsInefficient working on the w x h luma buffer,
+// ignoring the pixels not brighter than darkValue
+func ExtractMMIsBuffer(buf []byte, w, h int, grid []GridNode, darkValue byte, radius int) []float64 {
+	MMIs, _ := ExtractMMIsBufferStats(buf, w, h, grid, darkValue, radius)
+	return MMIs
+}
 
-	for i, node := range grid {
-		x0 := node.X - MMI_EXTRACTION_ELLIPSE_RADIUS
-		if x0 < 0 {
-			x0 = 0
-		}
-		y0 := node.Y - MMI_EXTRACTION_ELLIPSE_RADIUS
-		if y0 < 0 {
-			y0 = 0
-		}
-		x1 := node.X + MMI_EXTRACTION_ELLIPSE_RADIUS
-		if x1 >= CAMERA_FRAME_WIDTH {
-			x1 = CAMERA_FRAME_WIDTH - 1
-		}
-		y1 := node.Y + MMI_EXTRACTION_ELLIPSE_RADIUS
-		if y1 >= CAMERA_FRAME_HEIGHT {
-			y1 = CAMERA_FRAME_HEIGHT - 1
-		}
+// windowOverlap returns the first pixel overlapped by the window
+// [center-radius, center+radius] along an axis of size pixels, and the
+// overlapped fraction of each pixel, pixel p spanning [p-0.5, p+0.5]
+func windowOverlap(center float64, radius, size int) (int, []float64) {
+	low := center - float64(radius)
+	high := center + float64(radius)
+	first := int(math.Max(math.Floor(low+0.5), 0))
+	last := int(math.Min(math.Ceil(high-0.5), float64(size-1)))
+	if last < first {
+		return first, nil
+	}
+	overlaps := make([]float64, last-first+1)
+	for p := first; p <= last; p++ {
+		overlaps[p-first] = math.Min(high, float64(p)+0.5) - math.Max(low, float64(p)-0.5)
+	}
+	return first, overlaps
+}
 
-		roiWidth := x1 - x0
-		roiHeight := y1 - y0
+// ExtractMMIsBufferStats is ExtractMMIsBuffer also returning the
+// peak value and the share of clipped pixels of each MMI patch.
+// Patches are centered on the sub-pixel node positions, the pixels
+// being weighted by their fractional overlap with the patch
+func ExtractMMIsBufferStats(buf []byte, w, h int, grid []GridNode, darkValue byte, radius int) ([]float64, []MMIStats) {
+	MMIs := make([]float64, len(grid))
+	stats := make([]MMIStats, len(grid))
+
+	for i, node := range grid {
+		x0, overlapsX := windowOverlap(node.X, radius, w)
+		y0, overlapsY := windowOverlap(node.Y, radius, h)
 
-		sum := 0
-		count := 0
-		nzCount := 0
-		for roiRow := 0; roiRow < roiWidth; roiRow++ {
-			for roiCol := 0; roiCol < roiHeight; roiCol++ {
-				count++
-				idx := (y0+roiRow)*CAMERA_FRAME_WIDTH + (x0 + roiCol)
+		var sum float64
+		var weightSum float64
+		var nzWeightSum float64
+		var saturatedWeightSum float64
+		var peak byte
+		for roiRow, overlapY := range overlapsY {
+			for roiCol, overlapX := range overlapsX {
+				weight := overlapY * overlapX
+				if weight <= 0 {
+					continue
+				}
+				weightSum += weight
+				idx := (y0+roiRow)*w + (x0 + roiCol)
 				pixelValue := buf[idx]
+				if pixelValue > peak {
+					peak = pixelValue
+				}
+				if pixelValue >= MMI_SATURATION_VALUE {
+					saturatedWeightSum += weight
+				}
 				if pixelValue <= darkValue {
 					continue
 				}
-				nzCount++
-				sum += int(pixelValue)
+				nzWeightSum += weight
+				sum += weight * float64(pixelValue)
 			}
 		}
 		mean := .0
-		if nzCount > 0 {
-			mean = float64(sum) / float64(nzCount)
+		if nzWeightSum > 0 {
+			mean = sum / nzWeightSum
 		}
-		// log.Printf("BUF. I: %d; x0/y0: %d/%d; x1/y1: %d/%d; Count: %d; NZCount: %d; Mean: %f", i, x0, y0, x1, y1, count, nzCount, mean)
 		MMIs[i] = mean
+		stats[i].Peak = peak
+		if weightSum > 0 {
+			stats[i].SaturatedFraction = saturatedWeightSum / weightSum
+		}
 	}
 
-	return MMIs
+	return MMIs, stats
+}
+
+// MMIsQuality flags the saturated and underexposed MMIs
+func MMIsQuality(stats []MMIStats, darkValue byte, options ExtractionOptions) []uint32 {
+	qualities := make([]uint32, len(stats))
+	for i, s := range stats {
+		if s.SaturatedFraction > options.MaxSaturatedFraction {
+			qualities[i] |= QUALITY_SATURATED
+		}
+		if int(s.Peak)-int(darkValue) < options.MinPeakContrast {
+			qualities[i] |= QUALITY_UNDEREXPOSED
+		}
+	}
+	return qualities
+}
+
+// MZIsQuality flags the MZIs with the union of the flags of their MMIs
+func MZIsQuality(mmiQualities []uint32, layout *ChipLayout) []uint32 {
+	qualities := make([]uint32, layout.MZINodes())
+	for i, mmiIndices := range layout.MZIMMIIndices {
+		for _, idx := range mmiIndices {
+			qualities[i] |= mmiQualities[idx]
+		}
+	}
+	return qualities
 }
 
-func ExtractMZIsInefficient(MMIs [MMI_N_NODES]float64, grid [MMI_N_NODES]GridNode) [MZI_N_NODES]float64 {
-	var MZIs [MZI_N_NODES]float64
-	for i, mziConfig := range MZI_MMI_GRID_MAP {
-		a := mziConfig[0]
-		b := mziConfig[1]
-		c := mziConfig[2]
+func equalQualities(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ExtractMZIsInefficient(MMIs []float64, grid []GridNode, layout *ChipLayout) []float64 {
+	MZIs := make([]float64, layout.MZINodes())
+	for i, mziLayout := range layout.MZIs {
+		// Ordered as ChipLayout.MZIMMIIndices
+		a, b, c := mziLayout.MMIs[0], mziLayout.MMIs[1], mziLayout.MMIs[2]
+		if mziLayout.Order == MZI_ORDER_ABC {
+			a, c = c, a
+		}
 
 		var p1, p2, p3 float64
 
@@ -145,9 +235,9 @@ func ExtractMZIsInefficient(MMIs [MMI_N_NODES]float64, grid [MMI_N_NODES]GridNod
 	return MZIs
 }
 
-func ExtractMZIsIndexed(MMIs [MMI_N_NODES]float64, grid [MMI_N_NODES]GridNode) [MZI_N_NODES]float64 {
-	var MZIs [MZI_N_NODES]float64
-	for i, mmiIndices := range MZI_MMI_INDICES_MAP {
+func ExtractMZIsIndexed(MMIs []float64, layout *ChipLayout) []float64 {
+	MZIs := make([]float64, layout.MZINodes())
+	for i, mmiIndices := range layout.MZIMMIIndices {
 		// TODO: check abc/cba order
 		aIdx := mmiIndices[2]
 		bIdx := mmiIndices[1]
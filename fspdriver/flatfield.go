@@ -0,0 +1,234 @@
+package fspdriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Flat field gains, in the CalibrationPath option
+	FLAT_FIELD_FILE_NAME = "flat_field.json"
+	// Frames averaged into the acquired reference frame
+	FLAT_FIELD_SAMPLE_SIZE = 16
+	// Gains beyond are taken for dead or misplaced spots
+	FLAT_FIELD_MAX_GAIN = 4.0
+)
+
+// LoadFlatField reads the persisted flat field gains of the nMMIs MMIs.
+// A missing file means no correction
+func LoadFlatField(path string, nMMIs int) (FlatFieldMessage, error) {
+	var flatField FlatFieldMessage
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return flatField, nil
+	}
+	if err != nil {
+		return flatField, err
+	}
+	err = json.Unmarshal(content, &flatField)
+	if err != nil {
+		return flatField, fmt.Errorf("flat field file %s: %w", path, err)
+	}
+	return flatField, validateFlatField(flatField, nMMIs)
+}
+
+// SaveFlatField persists the gains, an empty gain map removing the file
+func SaveFlatField(path string, flatField FlatFieldMessage) error {
+	if len(flatField.Gains) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(flatField, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+func validateFlatField(flatField FlatFieldMessage, nMMIs int) error {
+	if len(flatField.Gains) == 0 {
+		return nil
+	}
+	if len(flatField.Gains) != nMMIs {
+		return fmt.Errorf("flat field: %d gains, expected %d", len(flatField.Gains), nMMIs)
+	}
+	for i, gain := range flatField.Gains {
+		if gain < 1/FLAT_FIELD_MAX_GAIN || gain > FLAT_FIELD_MAX_GAIN {
+			return fmt.Errorf("flat field: gain of MMI %d out of [%g, %g]: %g", i, 1/FLAT_FIELD_MAX_GAIN, FLAT_FIELD_MAX_GAIN, gain)
+		}
+	}
+	return nil
+}
+
+// ComputeFlatFieldGains derives the gains from the MMI values extracted
+// from a reference frame, where all the spots are expected to be equally bright.
+// Gains apply to the signal above the dark value and average to 1
+func ComputeFlatFieldGains(levels []float64, darkValue byte) ([]float64, error) {
+	var mean float64
+	for _, level := range levels {
+		mean += level - float64(darkValue)
+	}
+	mean /= float64(len(levels))
+
+	gains := make([]float64, len(levels))
+	for i, level := range levels {
+		signal := level - float64(darkValue)
+		if signal <= 0 {
+			return nil, fmt.Errorf("flat field: MMI %d is dark on the reference frame", i)
+		}
+		gains[i] = mean / signal
+	}
+	return gains, validateFlatField(FlatFieldMessage{Gains: gains}, len(levels))
+}
+
+// ApplyFlatField corrects the MMI values in place.
+// MMIs without any pixel above the dark value are left at 0
+func ApplyFlatField(MMIs []float64, gains []float64, darkValue byte) {
+	if len(gains) != len(MMIs) {
+		return
+	}
+	dark := float64(darkValue)
+	for i, mmi := range MMIs {
+		if mmi == 0 {
+			continue
+		}
+		MMIs[i] = dark + gains[i]*(mmi-dark)
+	}
+}
+
+func (d *Driver) getFlatFieldPath() string {
+	return filepath.Join(d.options.CalibrationPath, FLAT_FIELD_FILE_NAME)
+}
+
+// getFlatFieldGains returns the gains to be applied, if any
+func (d *Driver) getFlatFieldGains() []float64 {
+	if !d.options.Extraction.FlatFieldCorrection {
+		return nil
+	}
+	return d.getCalibration().FlatFieldGains
+}
+
+// acquireFlatField computes the gains on the reference frame
+// (averaged from the source, or read at path), with the calibrated grid
+func (d *Driver) acquireFlatField(ctx context.Context, source FrameSource, path string) ([]float64, error) {
+	calibration := d.getCalibration()
+	if len(calibration.EffectiveGrid) == 0 {
+		return nil, fmt.Errorf("no spots grid calibrated")
+	}
+	reference, err := d.acquireLumaImage(ctx, source, path, FLAT_FIELD_SAMPLE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	w := d.options.FrameWidth
+	h := d.options.FrameHeight
+	if darkFrame := d.getDarkFrame(); darkFrame != nil {
+		SubtractDarkFrame(reference, reference, darkFrame)
+	}
+	levels := ExtractMMIsBuffer(reference, w, h, calibration.EffectiveGrid, calibration.EffectiveDarkValue, d.options.Extraction.EllipseRadius)
+	return ComputeFlatFieldGains(levels, calibration.EffectiveDarkValue)
+}
+
+// setFlatField stores the gains with the calibration and persists them
+func (d *Driver) setFlatField(gains []float64) error {
+	err := SaveFlatField(d.getFlatFieldPath(), FlatFieldMessage{Gains: gains})
+	if err != nil {
+		return err
+	}
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.FlatFieldGains = gains
+	})
+	if LOG_LEVEL <= INFO_LEVEL {
+		if len(gains) == 0 {
+			INFOLogger.Println("Flat field cleared")
+		} else {
+			INFOLogger.Println("Flat field set")
+		}
+	}
+	return err
+}
+
+// commandFlatField sets (or clears) the gains, restarting the camera if it is active
+func (d *Driver) commandFlatField(flatField FlatFieldMessage) (FlatFieldMessage, error) {
+	current := FlatFieldMessage{Gains: d.getCalibration().FlatFieldGains}
+	err := validateFlatField(flatField, d.layout.MMINodes())
+	if err != nil {
+		return current, err
+	}
+	if equalGains(flatField.Gains, current.Gains) {
+		return current, err
+	}
+	var setErr error
+	err = d.reconfigureCameraPipeline(func() {
+		setErr = d.setFlatField(flatField.Gains)
+	})
+	if setErr != nil {
+		err = setErr
+	}
+	return FlatFieldMessage{Gains: d.getCalibration().FlatFieldGains}, err
+}
+
+func equalGains(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Driver) GetFlatFieldHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_GET_FLAT_FIELD_CB_MQTT_TOPIC_PATH)
+
+	respObj := MQTTResponse{
+		Message: FlatFieldMessage{Gains: d.getCalibration().FlatFieldGains},
+	}
+	err = PublishJsonMsg(respTopic, respObj, client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in GetFlatFieldHandler MQTT CB: %s", err.Error())
+		}
+	}
+}
+
+func (d *Driver) SetFlatFieldHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_FLAT_FIELD_CB_MQTT_TOPIC_PATH)
+
+	payload := msg.Payload()
+	var flatField FlatFieldMessage
+	err = json.Unmarshal(payload, &flatField)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetFlatFieldHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
+		}
+	}
+	d.submitCommand(command{
+		name:      fmt.Sprintf("SET_FLAT_FIELD=%d gains", len(flatField.Gains)),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err != nil {
+				return FlatFieldMessage{Gains: d.getCalibration().FlatFieldGains}, err
+			}
+			return d.commandFlatField(flatField)
+		},
+	})
+}
@@ -0,0 +1,244 @@
+package fspdriver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FRAME_SOURCE_LIBCAMERA = "libcamera"
+	FRAME_SOURCE_SIMULATOR = "simulator"
+	FRAME_SOURCE_REPLAY    = "replay"
+)
+
+// ErrEndOfStream is returned by NextFrame of the sources
+// which have a natural end (e.g. replays)
+var ErrEndOfStream = errors.New("end of frame stream")
+
+// FRAME_SOURCES registers the available FrameSource constructors by name.
+// The effective one is selected with DriverOptions.FrameSource
+var FRAME_SOURCES = map[string]func(options DriverOptions) FrameSource{
+	FRAME_SOURCE_LIBCAMERA: func(options DriverOptions) FrameSource {
+		return NewLibcameraFrameSource()
+	},
+	FRAME_SOURCE_SIMULATOR: func(options DriverOptions) FrameSource {
+		return NewSimulatorFrameSource(options.SimulatorConfig, options.ChipLayout)
+	},
+	FRAME_SOURCE_REPLAY: func(options DriverOptions) FrameSource {
+		return NewReplayFrameSource(options.ReplayPath, options.ReplaySpeed)
+	},
+}
+
+// CameraSettings holds the acquisition parameters
+// a FrameSource is opened with
+type CameraSettings struct {
+	Width        int
+	Height       int
+	Framerate    int
+	ShutterSpeed int
+	// Analogue gain
+	Gain float64
+}
+
+// FrameSource provides raw NV12 (YUV4:2:0) frames of
+// the Width x Height pixels given in the settings,
+// i.e. the luma plane followed by the half-sized chroma plane
+type FrameSource interface {
+	// Open starts the acquisition with given settings
+	Open(settings CameraSettings) error
+	// NextFrame blocks until the next frame is available.
+	// The returned buffer is only valid until the next call
+	NextFrame() ([]byte, time.Time, error)
+	// Close stops the acquisition and releases the resources
+	Close() error
+}
+
+// ExposureController is implemented by the frame sources
+// whose exposure can be changed while acquiring
+type ExposureController interface {
+	SetExposure(shutterSpeed int, gain float64) error
+}
+
+// NewFrameSource instantiates a registered FrameSource by its name
+func NewFrameSource(name string, options DriverOptions) (FrameSource, error) {
+	newSource, ok := FRAME_SOURCES[name]
+	if !ok {
+		names := make([]string, 0, len(FRAME_SOURCES))
+		for n := range FRAME_SOURCES {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown frame source: %s. Available: %v", name, names)
+	}
+	return newSource(options), nil
+}
+
+// LibcameraFrameSource reads frames from the stdout
+// of a libcamera-raw process
+type LibcameraFrameSource struct {
+	// Guards the process against concurrent NextFrame, SetExposure and Close
+	mut      sync.Mutex
+	settings CameraSettings
+	closed   bool
+
+	cmd    *exec.Cmd
+	reader *bufio.Reader
+	buf    []byte
+	// Incremented on each respawn, for a read from the previous process to be retried
+	generation int
+	// Frames to drop after a respawn, and whether it is still settling
+	purge      int
+	respawning int32
+}
+
+func NewLibcameraFrameSource() *LibcameraFrameSource {
+	return &LibcameraFrameSource{}
+}
+
+func (s *LibcameraFrameSource) Open(settings CameraSettings) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.settings = settings
+	s.closed = false
+	s.buf = make([]byte, settings.Width*settings.Height+settings.Width*settings.Height/2)
+	return s.start()
+}
+
+// SetExposure respawns the libcamera-raw process with the new shutter speed
+// and gain: libcamera-raw takes no controls while it runs.
+// The first CAMERA_SAMPLE_PURGE_SIZE frames of the new process, not settled yet,
+// are dropped by NextFrame, and the source reports Respawning meanwhile
+func (s *LibcameraFrameSource) SetExposure(shutterSpeed int, gain float64) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("libcamera: source is closed")
+	}
+	atomic.StoreInt32(&s.respawning, 1)
+	err := s.kill()
+	if err != nil {
+		return err
+	}
+	s.settings.ShutterSpeed = shutterSpeed
+	s.settings.Gain = gain
+	s.purge = CAMERA_SAMPLE_PURGE_SIZE
+	return s.start()
+}
+
+// Respawning tells whether the process is being respawned, or its first frames dropped
+func (s *LibcameraFrameSource) Respawning() bool {
+	return atomic.LoadInt32(&s.respawning) == 1
+}
+
+func (s *LibcameraFrameSource) start() error {
+	settings := s.settings
+	cmd := exec.Command(
+		"libcamera-raw",
+		"--camera", "0",
+		"--width", fmt.Sprint(settings.Width),
+		"--height", fmt.Sprint(settings.Height),
+		"--framerate", fmt.Sprint(settings.Framerate),
+		"--flush", "1",
+		"-t", "0",
+		"--shutter", fmt.Sprint(settings.ShutterSpeed),
+		"--gain", fmt.Sprint(settings.Gain),
+		"--ev", "0",
+		"--denoise", "off",
+		"--contrast", "1",
+		"-o", "-",
+	)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	s.cmd = cmd
+	s.reader = bufio.NewReader(out)
+	s.generation++
+	return err
+}
+
+// NextFrame reads from the process current when called, without holding the lock
+// for Close to unblock the read. A read cut by a respawn is retried on the new process
+func (s *LibcameraFrameSource) NextFrame() ([]byte, time.Time, error) {
+	for {
+		s.mut.Lock()
+		reader, buf, generation := s.reader, s.buf, s.generation
+		s.mut.Unlock()
+		if reader == nil {
+			return buf, time.Now(), fmt.Errorf("libcamera: source is not open")
+		}
+
+		_, err := io.ReadFull(reader, buf)
+
+		s.mut.Lock()
+		respawned := s.generation != generation && !s.closed
+		purged := err == nil && !respawned && s.purge > 0
+		if purged {
+			s.purge--
+		} else if err == nil && !respawned {
+			atomic.StoreInt32(&s.respawning, 0)
+		}
+		s.mut.Unlock()
+		if respawned || purged {
+			continue
+		}
+		return buf, time.Now(), err
+	}
+}
+
+func (s *LibcameraFrameSource) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.closed = true
+	atomic.StoreInt32(&s.respawning, 0)
+	return s.kill()
+}
+
+func (s *LibcameraFrameSource) kill() error {
+	var err error
+	if s.cmd == nil || s.cmd.Process == nil {
+		return err
+	}
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Println("Killing camera..")
+	}
+	err = s.cmd.Process.Kill()
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Println(err)
+		}
+	}
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Println("Waiting camera..")
+	}
+	// cmd.Wait, unlike Process.Wait, also closes the stdout pipe.
+	// The exit status of the killed process is no error
+	err = s.cmd.Wait()
+	if err != nil {
+		if LOG_LEVEL <= DEBUG_LEVEL {
+			DEBUGLogger.Println(err)
+		}
+		if _, exited := err.(*exec.ExitError); exited {
+			err = nil
+		}
+	}
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Println("Camera state after killing and waiting: ", s.cmd.ProcessState.String())
+	}
+	s.cmd = nil
+	return err
+}
@@ -0,0 +1,469 @@
+package fspdriver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gocv.io/x/gocv"
+)
+
+const (
+	// Spots grid file, in the CalibrationPath option unless GridOptions.Path is set
+	SPOTSGRID_FILE_NAME = "spotsgrid.json"
+
+	// How the effective grid was obtained
+	GRID_SOURCE_DETECTED = "detected"
+	// Stored grid, shifted onto the spots found around its nodes
+	GRID_SOURCE_REFINED = "refined"
+	// Stored grid, not verified yet
+	GRID_SOURCE_STORED = "stored"
+	// Set with /camera/grid/set, standing for the grid calibration step
+	GRID_SOURCE_MANUAL = "manual"
+
+	// Defaults of GridOptions
+	GRID_VERIFY_MAX_RESIDUAL         = 2.0
+	GRID_VERIFY_MIN_MATCHED_FRACTION = 0.9
+)
+
+// LoadSpotsgrid reads the persisted spots grid.
+// A missing file means no grid, with an empty Nodes
+func LoadSpotsgrid(path string) (SpotsGridMessage, error) {
+	var spotsGrid SpotsGridMessage
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return spotsGrid, nil
+	}
+	if err != nil {
+		return spotsGrid, err
+	}
+	err = json.Unmarshal(content, &spotsGrid)
+	if err != nil {
+		return spotsGrid, fmt.Errorf("spots grid file %s: %w", path, err)
+	}
+	return spotsGrid, err
+}
+
+func SaveSpotsgrid(path string, spotsGrid SpotsGridMessage) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(spotsGrid, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// validateSpotsgrid checks the grid fits the chip layout
+func validateSpotsgrid(spotsGrid SpotsGridMessage, layout *ChipLayout) error {
+	if spotsGrid.ChipLayout != layout.Name {
+		return fmt.Errorf("grid of chip layout %q, expected %q", spotsGrid.ChipLayout, layout.Name)
+	}
+	if len(spotsGrid.Nodes) != layout.MMINodes() {
+		return fmt.Errorf("grid has %d nodes, chip layout %s has %d", len(spotsGrid.Nodes), layout.Name, layout.MMINodes())
+	}
+	for n, node := range spotsGrid.Nodes {
+		if node.Row != layout.Nodes[n].Row || node.Col != layout.Nodes[n].Col {
+			return fmt.Errorf("grid node %d at [row, col] [%d, %d], expected [%d, %d]", n, node.Row, node.Col, layout.Nodes[n].Row, layout.Nodes[n].Col)
+		}
+	}
+	return nil
+}
+
+// spotCentroid returns the intensity centroid of the spot within
+// radius of x, y (rounded to the pixel) on the w*h image, weighted above the window minimum.
+// Not found if the window peak is less than minContrast above its minimum
+func spotCentroid(pixel func(i int) int, w, h int, nodeX, nodeY float64, radius, minContrast int) (float64, float64, bool) {
+	x := int(math.Round(nodeX))
+	y := int(math.Round(nodeY))
+	x0, y0 := maxInt(x-radius, 0), maxInt(y-radius, 0)
+	x1, y1 := minInt(x+radius, w-1), minInt(y+radius, h-1)
+	if x0 > x1 || y0 > y1 {
+		return 0, 0, false
+	}
+
+	lowest, peak := math.MaxInt, 0
+	for py := y0; py <= y1; py++ {
+		for px := x0; px <= x1; px++ {
+			v := pixel(py*w + px)
+			lowest = minInt(lowest, v)
+			peak = maxInt(peak, v)
+		}
+	}
+	if peak-lowest < minContrast || peak == lowest {
+		return 0, 0, false
+	}
+
+	var sum, sumX, sumY float64
+	for py := y0; py <= y1; py++ {
+		for px := x0; px <= x1; px++ {
+			weight := float64(pixel(py*w+px) - lowest)
+			sum += weight
+			sumX += weight * float64(px)
+			sumY += weight * float64(py)
+		}
+	}
+	return sumX / sum, sumY / sum, true
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// RefineSpotsGrid verifies the stored grid against the spots of the sampled
+// frame (CV16UC1), and shifts it onto them. Verification fails if less than
+// MinMatchedFraction of the spots are found around the nodes, or if their
+// mean residual to the shifted nodes exceeds MaxResidual
+func RefineSpotsGrid(mat gocv.Mat, stored SpotsGridMessage, options GridOptions, radius, minContrast int) (SpotsGridMessage, error) {
+	refined := stored
+	data, err := mat.DataPtrUint16()
+	if err != nil {
+		return refined, err
+	}
+	w := mat.Cols()
+	h := mat.Rows()
+	pixel := func(i int) int { return int(data[i]) }
+
+	var dxs, dys []float64
+	for _, node := range stored.Nodes {
+		cx, cy, ok := spotCentroid(pixel, w, h, node.X, node.Y, radius, minContrast)
+		if !ok {
+			continue
+		}
+		dxs = append(dxs, cx-node.X)
+		dys = append(dys, cy-node.Y)
+	}
+	metrics := GridMetrics{MatchedNodes: len(dxs)}
+	if float64(len(dxs)) < options.MinMatchedFraction*float64(len(stored.Nodes)) {
+		return refined, fmt.Errorf("%d/%d spots found around the stored grid nodes", len(dxs), len(stored.Nodes))
+	}
+
+	// Median shift, robust to the odd spot found off its node
+	metrics.ShiftX = median(dxs)
+	metrics.ShiftY = median(dys)
+	var residualAcc float64
+	for i := range dxs {
+		residualAcc += math.Hypot(dxs[i]-metrics.ShiftX, dys[i]-metrics.ShiftY)
+	}
+	metrics.MeanResidual = residualAcc / float64(len(dxs))
+	if metrics.MeanResidual > options.MaxResidual {
+		return refined, fmt.Errorf("spots %.2f px off the stored grid nodes on average, beyond %.2f px", metrics.MeanResidual, options.MaxResidual)
+	}
+
+	refined.Nodes = make([]GridNode, len(stored.Nodes))
+	for n, node := range stored.Nodes {
+		node.X += metrics.ShiftX
+		node.Y += metrics.ShiftY
+		refined.Nodes[n] = node
+	}
+	refined.CenterX += metrics.ShiftX
+	refined.CenterY += metrics.ShiftY
+	refined.Source = GRID_SOURCE_REFINED
+	refined.Metrics = metrics
+	refined.Timestamp = int(time.Now().UnixMilli())
+	return refined, err
+}
+
+func (d *Driver) getSpotsgridPath() string {
+	if d.options.Grid.Path != "" {
+		return d.options.Grid.Path
+	}
+	return filepath.Join(d.options.CalibrationPath, SPOTSGRID_FILE_NAME)
+}
+
+// getSpotsGrid returns the effective grid along with its geometry
+func (d *Driver) getSpotsGrid() SpotsGridMessage {
+	calibration := d.getCalibration()
+	return SpotsGridMessage{
+		ChipLayout:   d.layout.Name,
+		Nodes:        calibration.EffectiveGrid,
+		GridGeometry: calibration.EffectiveGridGeometry,
+	}
+}
+
+// setSpotsGrid makes the grid the effective one and persists it
+func (d *Driver) setSpotsGrid(spotsGrid SpotsGridMessage) {
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.EffectiveGrid = spotsGrid.Nodes
+		calibration.EffectiveGridGeometry = spotsGrid.GridGeometry
+	})
+	err := SaveSpotsgrid(d.getSpotsgridPath(), spotsGrid)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Could not persist the spots grid: %s", err.Error())
+		}
+	}
+}
+
+// loadStoredSpotsGrid takes the persisted grid as the effective one if it was
+// set manually, or if GridOptions.ReuseStored, to be verified by the grid calibration step
+func (d *Driver) loadStoredSpotsGrid() error {
+	path := d.getSpotsgridPath()
+	stored, err := LoadSpotsgrid(path)
+	if err != nil || len(stored.Nodes) == 0 {
+		return err
+	}
+	if stored.Source != GRID_SOURCE_MANUAL && !d.options.Grid.ReuseStored {
+		return nil
+	}
+	err = validateSpotsgrid(stored, d.layout)
+	if err != nil {
+		if LOG_LEVEL <= WARNING_LEVEL {
+			WARNINGLogger.Printf("Ignoring the stored spots grid %s: %s", path, err.Error())
+		}
+		return nil
+	}
+	if stored.Source != GRID_SOURCE_MANUAL {
+		stored.Source = GRID_SOURCE_STORED
+	}
+	d.calibration.EffectiveGrid = stored.Nodes
+	d.calibration.EffectiveGridGeometry = stored.GridGeometry
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Loaded %s spots grid %s. Angle: %.2f deg, center: %.1f, %.1f", stored.Source, path, stored.AngleDeg, stored.CenterX, stored.CenterY)
+	}
+	return nil
+}
+
+// calibrateSpotsGrid starts from the current grid if GridOptions.ReuseStored,
+// verifying and refining it on the sampled frame. It falls back to
+// (or goes straight to) the full detection. The manual grid, if any, stands for it
+func (d *Driver) calibrateSpotsGrid(mat gocv.Mat) (SpotsGridMessage, error) {
+	current := d.getSpotsGrid()
+	if current.Source == GRID_SOURCE_MANUAL {
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Println("Manual spots grid, detection bypassed")
+		}
+		return current, nil
+	}
+	if d.options.Grid.ReuseStored && len(current.Nodes) == d.layout.MMINodes() {
+		refined, err := RefineSpotsGrid(mat, current, d.options.Grid, d.options.Extraction.EllipseRadius, d.options.Extraction.MinPeakContrast)
+		if err == nil {
+			if LOG_LEVEL <= INFO_LEVEL {
+				INFOLogger.Printf("Spots grid verified. Matched: %d, shift: %.2f, %.2f px, mean residual: %.2f px",
+					refined.Metrics.MatchedNodes, refined.Metrics.ShiftX, refined.Metrics.ShiftY, refined.Metrics.MeanResidual)
+			}
+			return refined, err
+		}
+		if LOG_LEVEL <= WARNING_LEVEL {
+			WARNINGLogger.Printf("Spots grid verification failed, detecting it: %s", err.Error())
+		}
+	}
+	spotsGrid, diagnostics, err := DetectSpotsGrid(mat, d.layout, d.options.NodeDetection, d.options.ImagesPath, d.options.Extraction.EllipseRadius)
+	d.publishGridDiagnostics(diagnostics)
+	return spotsGrid, err
+}
+
+func (d *Driver) publishGridDiagnostics(diagnostics GridDiagnostics) {
+	topic := d.getFullTopicString(CAMERA_GRID_DIAGNOSTICS_MQTT_TOPIC_PATH)
+	err := PublishJsonMsg(topic, diagnostics, d.client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing grid diagnostics: %s", err.Error())
+		}
+	}
+}
+
+// latticeNodes places the chip layout nodes on the lattice
+func latticeNodes(lattice GridLattice, layout *ChipLayout) SpotsGridMessage {
+	spotsGrid := SpotsGridMessage{ChipLayout: layout.Name}
+	angleRad := deg2Rad(lattice.AngleDeg)
+	place := func(col, row float64) (float64, float64) {
+		x := col * lattice.PitchX
+		y := row * lattice.PitchY
+		return lattice.OriginX + x*math.Cos(angleRad) - y*math.Sin(angleRad),
+			lattice.OriginY + x*math.Sin(angleRad) + y*math.Cos(angleRad)
+	}
+	spotsGrid.Nodes = make([]GridNode, layout.MMINodes())
+	for n, layoutNode := range layout.Nodes {
+		x, y := place(float64(layoutNode.Col), float64(layoutNode.Row))
+		spotsGrid.Nodes[n] = GridNode{
+			X:   x,
+			Y:   y,
+			Row: layoutNode.Row,
+			Col: layoutNode.Col,
+		}
+	}
+	spotsGrid.AngleDeg = lattice.AngleDeg
+	spotsGrid.CenterX, spotsGrid.CenterY = place(float64(layout.Cols-1)/2, float64(layout.Rows-1)/2)
+	return spotsGrid
+}
+
+// nudgeSpotsGrid rotates the grid by rotationDeg around its center, then shifts it
+func nudgeSpotsGrid(spotsGrid SpotsGridMessage, shiftX, shiftY, rotationDeg float64) SpotsGridMessage {
+	nudged := spotsGrid
+	if nudged.CenterX == 0 && nudged.CenterY == 0 {
+		// No geometry, e.g. from a recording
+		for _, node := range spotsGrid.Nodes {
+			nudged.CenterX += node.X / float64(len(spotsGrid.Nodes))
+			nudged.CenterY += node.Y / float64(len(spotsGrid.Nodes))
+		}
+	}
+	angleRad := deg2Rad(rotationDeg)
+	nudged.Nodes = make([]GridNode, len(spotsGrid.Nodes))
+	for n, node := range spotsGrid.Nodes {
+		x := node.X - nudged.CenterX
+		y := node.Y - nudged.CenterY
+		node.X = nudged.CenterX + x*math.Cos(angleRad) - y*math.Sin(angleRad) + shiftX
+		node.Y = nudged.CenterY + x*math.Sin(angleRad) + y*math.Cos(angleRad) + shiftY
+		nudged.Nodes[n] = node
+	}
+	nudged.CenterX += shiftX
+	nudged.CenterY += shiftY
+	nudged.AngleDeg += rotationDeg
+	return nudged
+}
+
+// manualSpotsGrid builds the grid set with /camera/grid/set
+func (d *Driver) manualSpotsGrid(gridSet GridSetMessage) (SpotsGridMessage, error) {
+	var spotsGrid SpotsGridMessage
+
+	switch {
+	case len(gridSet.Nodes) > 0:
+		if len(gridSet.Nodes) != d.layout.MMINodes() {
+			return spotsGrid, fmt.Errorf("%d nodes, chip layout %s has %d", len(gridSet.Nodes), d.layout.Name, d.layout.MMINodes())
+		}
+		spotsGrid.ChipLayout = d.layout.Name
+		spotsGrid.Nodes = make([]GridNode, len(gridSet.Nodes))
+		for n, node := range gridSet.Nodes {
+			// Row and Col are the layout ones
+			node.Row = d.layout.Nodes[n].Row
+			node.Col = d.layout.Nodes[n].Col
+			spotsGrid.Nodes[n] = node
+			spotsGrid.CenterX += node.X / float64(len(gridSet.Nodes))
+			spotsGrid.CenterY += node.Y / float64(len(gridSet.Nodes))
+		}
+	case gridSet.Lattice != nil:
+		if gridSet.Lattice.PitchX <= 0 || gridSet.Lattice.PitchY <= 0 {
+			return spotsGrid, fmt.Errorf("invalid lattice pitch: %g, %g. Must be positive", gridSet.Lattice.PitchX, gridSet.Lattice.PitchY)
+		}
+		spotsGrid = latticeNodes(*gridSet.Lattice, d.layout)
+	default:
+		current := d.getSpotsGrid()
+		if len(current.Nodes) != d.layout.MMINodes() {
+			return spotsGrid, fmt.Errorf("no grid to shift, provide Nodes or a Lattice")
+		}
+		spotsGrid = nudgeSpotsGrid(current, gridSet.ShiftX, gridSet.ShiftY, gridSet.RotationDeg)
+	}
+
+	for n, node := range spotsGrid.Nodes {
+		if node.X < 0 || node.X > float64(d.options.FrameWidth-1) || node.Y < 0 || node.Y > float64(d.options.FrameHeight-1) {
+			return spotsGrid, fmt.Errorf("node %d [%d:%d] out of the frame: %.1f, %.1f", n, node.Row, node.Col, node.X, node.Y)
+		}
+	}
+	spotsGrid.Source = GRID_SOURCE_MANUAL
+	spotsGrid.Metrics = GridMetrics{}
+	spotsGrid.Timestamp = int(time.Now().UnixMilli())
+	return spotsGrid, nil
+}
+
+// commandSpotsGrid sets the grid manually, persists it and restarts the camera
+// if it is active. Releasing the manual grid keeps it effective until the next
+// grid calibration, which detects it again
+func (d *Driver) commandSpotsGrid(gridSet GridSetMessage) (SpotsGridMessage, error) {
+	if !gridSet.Manual {
+		current := d.getSpotsGrid()
+		if current.Source != GRID_SOURCE_MANUAL {
+			return current, nil
+		}
+		current.Source = GRID_SOURCE_STORED
+		d.setSpotsGrid(current)
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Println("Manual spots grid released")
+		}
+		return d.getSpotsGrid(), nil
+	}
+
+	spotsGrid, err := d.manualSpotsGrid(gridSet)
+	if err != nil {
+		return d.getSpotsGrid(), err
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Setting spots grid manually. Angle: %.2f deg, center: %.1f, %.1f", spotsGrid.AngleDeg, spotsGrid.CenterX, spotsGrid.CenterY)
+	}
+	err = d.reconfigureCameraPipeline(func() {
+		d.setSpotsGrid(spotsGrid)
+	})
+	return d.getSpotsGrid(), err
+}
+
+func (d *Driver) GetSpotsGridHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_GET_GRID_CB_MQTT_TOPIC_PATH)
+
+	respObj := MQTTResponse{
+		Message: d.getSpotsGrid(),
+	}
+	err = PublishJsonMsg(respTopic, respObj, client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in GetSpotsGridHandler MQTT CB: %s", err.Error())
+		}
+	}
+}
+
+func (d *Driver) SetSpotsGridHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_GRID_CB_MQTT_TOPIC_PATH)
+
+	payload := msg.Payload()
+	var gridSet GridSetMessage
+	err = json.Unmarshal(payload, &gridSet)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetSpotsGridHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
+		}
+	}
+	name := "SET_GRID=release"
+	switch {
+	case !gridSet.Manual:
+	case len(gridSet.Nodes) > 0:
+		name = fmt.Sprintf("SET_GRID=%d nodes", len(gridSet.Nodes))
+	case gridSet.Lattice != nil:
+		name = fmt.Sprintf("SET_GRID=%+v", *gridSet.Lattice)
+	default:
+		name = fmt.Sprintf("SET_GRID=shift %g, %g, rotation %g", gridSet.ShiftX, gridSet.ShiftY, gridSet.RotationDeg)
+	}
+	d.submitCommand(command{
+		name:      name,
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err != nil {
+				return d.getSpotsGrid(), err
+			}
+			return d.commandSpotsGrid(gridSet)
+		},
+	})
+}
@@ -0,0 +1,237 @@
+package fspdriver
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	// Defaults of GridTrackingOptions
+	GRID_TRACKING_INTERVAL             = 30
+	GRID_TRACKING_SMOOTHING            = 0.3
+	GRID_TRACKING_MIN_MATCHED_FRACTION = 0.5
+	GRID_TRACKING_MAX_DRIFT            = 20.0
+
+	// Min period between two saves of the corrected grid
+	GRID_TRACKING_SAVE_PERIOD = 1 * time.Minute
+)
+
+// GridTracker follows the drift of the spots (thermal expansion, mechanical creep)
+// while running. Every interval, it looks for the spot centroid around each node
+// of the corrected grid, fits the rotation (around the grid center) and shift
+// mapping the calibrated grid onto them, and moves the corrected grid by the
+// exponentially smoothed estimate.
+// Estimates run in the background, see runGridTracker
+type GridTracker struct {
+	options     GridTrackingOptions
+	radius      int
+	minContrast int
+
+	reference        []GridNode
+	centerX, centerY float64
+	grid             []GridNode
+
+	// Smoothed correction
+	shiftX, shiftY, rotationRad float64
+}
+
+func NewGridTracker(options GridTrackingOptions, extraction ExtractionOptions, reference []GridNode) *GridTracker {
+	t := &GridTracker{
+		options:     options,
+		radius:      extraction.EllipseRadius,
+		minContrast: extraction.MinPeakContrast,
+		reference:   reference,
+		grid:        reference,
+	}
+	for _, node := range reference {
+		t.centerX += node.X / float64(len(reference))
+		t.centerY += node.Y / float64(len(reference))
+	}
+	return t
+}
+
+// Grid returns the corrected grid
+func (t *GridTracker) Grid() []GridNode {
+	return t.grid
+}
+
+// Place returns the corrected position of the reference point x, y
+func (t *GridTracker) Place(x, y float64) (float64, float64) {
+	cos, sin := math.Cos(t.rotationRad), math.Sin(t.rotationRad)
+	x -= t.centerX
+	y -= t.centerY
+	return t.centerX + x*cos - y*sin + t.shiftX, t.centerY + x*sin + y*cos + t.shiftY
+}
+
+// Update estimates the drift on the w*h luma plane, and returns it and whether
+// the correction was updated. It is left as is when too few spots are found
+// or the drift exceeds MaxDrift
+func (t *GridTracker) Update(buf []byte, w, h int) (GridDriftMessage, bool) {
+	var drift GridDriftMessage
+	pixel := func(i int) int { return int(buf[i]) }
+	var refs, spots [][2]float64
+	for n, node := range t.grid {
+		cx, cy, ok := spotCentroid(pixel, w, h, node.X, node.Y, t.radius, t.minContrast)
+		if !ok {
+			continue
+		}
+		refs = append(refs, [2]float64{t.reference[n].X, t.reference[n].Y})
+		spots = append(spots, [2]float64{cx, cy})
+	}
+	drift.MatchedNodes = len(spots)
+	if len(spots) == 0 || float64(len(spots)) < t.options.MinMatchedFraction*float64(len(t.grid)) {
+		if LOG_LEVEL <= WARNING_LEVEL {
+			WARNINGLogger.Printf("GridTracker: %d/%d spots found, correction kept", len(spots), len(t.grid))
+		}
+		return t.fill(drift), false
+	}
+
+	shiftX, shiftY, rotationRad, residual := fitRigid(refs, spots, t.centerX, t.centerY)
+	drift.MeasuredShiftX = shiftX
+	drift.MeasuredShiftY = shiftY
+	drift.MeasuredRotationDeg = rad2Deg(rotationRad)
+	drift.MeanResidual = residual
+	if math.Hypot(shiftX, shiftY) > t.options.MaxDrift {
+		if LOG_LEVEL <= WARNING_LEVEL {
+			WARNINGLogger.Printf("GridTracker: drift %.1f, %.1f px beyond %.1f px, correction kept. Recalibrate the grid", shiftX, shiftY, t.options.MaxDrift)
+		}
+		return t.fill(drift), false
+	}
+
+	alpha := t.options.Smoothing
+	t.shiftX += alpha * (shiftX - t.shiftX)
+	t.shiftY += alpha * (shiftY - t.shiftY)
+	t.rotationRad += alpha * (rotationRad - t.rotationRad)
+
+	grid := make([]GridNode, len(t.reference))
+	for n, node := range t.reference {
+		node.X, node.Y = t.Place(node.X, node.Y)
+		grid[n] = node
+		drift.MaxNodeShift = math.Max(drift.MaxNodeShift, math.Hypot(node.X-t.grid[n].X, node.Y-t.grid[n].Y))
+	}
+	t.grid = grid
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Printf("GridTracker: measured %.2f, %.2f px, %.3f deg; correction %.2f, %.2f px, %.3f deg",
+			shiftX, shiftY, rad2Deg(rotationRad), t.shiftX, t.shiftY, rad2Deg(t.rotationRad))
+	}
+	return t.fill(drift), true
+}
+
+// fill reports the current correction
+func (t *GridTracker) fill(drift GridDriftMessage) GridDriftMessage {
+	drift.ShiftX = t.shiftX
+	drift.ShiftY = t.shiftY
+	drift.RotationDeg = rad2Deg(t.rotationRad)
+	return drift
+}
+
+// fitRigid returns the least-squares rotation around cx, cy and the shift
+// mapping the refs onto the spots, and the mean residual (px)
+func fitRigid(refs, spots [][2]float64, cx, cy float64) (float64, float64, float64, float64) {
+	n := float64(len(refs))
+	var refMeanX, refMeanY, spotMeanX, spotMeanY float64
+	for i := range refs {
+		refMeanX += refs[i][0] / n
+		refMeanY += refs[i][1] / n
+		spotMeanX += spots[i][0] / n
+		spotMeanY += spots[i][1] / n
+	}
+	var cross, dot float64
+	for i := range refs {
+		rx, ry := refs[i][0]-refMeanX, refs[i][1]-refMeanY
+		sx, sy := spots[i][0]-spotMeanX, spots[i][1]-spotMeanY
+		cross += rx*sy - ry*sx
+		dot += rx*sx + ry*sy
+	}
+	rotationRad := math.Atan2(cross, dot)
+	cos, sin := math.Cos(rotationRad), math.Sin(rotationRad)
+
+	// spot = c + R(ref - c) + shift
+	shiftX := spotMeanX - cx - ((refMeanX-cx)*cos - (refMeanY-cy)*sin)
+	shiftY := spotMeanY - cy - ((refMeanX-cx)*sin + (refMeanY-cy)*cos)
+
+	var residualAcc float64
+	for i := range refs {
+		x := refs[i][0] - cx
+		y := refs[i][1] - cy
+		residualAcc += math.Hypot(cx+x*cos-y*sin+shiftX-spots[i][0], cy+x*sin+y*cos+shiftY-spots[i][1])
+	}
+	return shiftX, shiftY, rotationRad, residualAcc / n
+}
+
+// gridTrackerFrame is a copy of the luma plane of frame I, to estimate the drift on
+type gridTrackerFrame struct {
+	buf       []byte
+	i         int
+	timestamp int
+}
+
+// runGridTracker estimates the drift on the frames received until ctx is done,
+// off the main loop: the main loop hands a frame over every interval, unless an
+// estimate is running, and takes the corrected grids back from grids.
+// Each estimate is published, and the corrected grid written back as the effective
+// one (EffectiveGrid), geometry updated from the reference one, for the grid getters,
+// commands and restarts to start from it. It is saved at most every GRID_TRACKING_SAVE_PERIOD
+func (d *Driver) runGridTracker(ctx context.Context, tracker *GridTracker, reference GridGeometry, frames <-chan gridTrackerFrame, grids chan []GridNode) {
+	var lastSave time.Time
+	var unsaved bool
+	save := func() {
+		err := SaveSpotsgrid(d.getSpotsgridPath(), d.getSpotsGrid())
+		if err != nil {
+			if LOG_LEVEL <= ERROR_LEVEL {
+				ERRORLogger.Printf("Could not persist the tracked spots grid: %s", err.Error())
+			}
+		}
+		lastSave = time.Now()
+		unsaved = false
+	}
+	defer func() {
+		if unsaved {
+			save()
+		}
+	}()
+
+	for {
+		var frame gridTrackerFrame
+		select {
+		case <-ctx.Done():
+			return
+		case frame = <-frames:
+		}
+
+		drift, corrected := tracker.Update(frame.buf, d.options.FrameWidth, d.options.FrameHeight)
+		drift.I = frame.i
+		drift.Timestamp = frame.timestamp
+		err := PublishJsonMsg(d.getFullTopicString(CAMERA_GRID_DRIFT_BROADCAST_MQTT_TOPIC_PATH), drift, d.client)
+		if err != nil {
+			if LOG_LEVEL <= ERROR_LEVEL {
+				ERRORLogger.Printf("Error occurred while publishing grid drift: %s", err.Error())
+			}
+		}
+		if !corrected {
+			continue
+		}
+
+		grid := tracker.Grid()
+		geometry := reference
+		geometry.AngleDeg += drift.RotationDeg
+		geometry.CenterX, geometry.CenterY = tracker.Place(reference.CenterX, reference.CenterY)
+		geometry.Timestamp = int(time.Now().UnixMilli())
+		d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+			calibration.EffectiveGrid = grid
+			calibration.EffectiveGridGeometry = geometry
+		})
+		unsaved = true
+		if time.Since(lastSave) > GRID_TRACKING_SAVE_PERIOD {
+			save()
+		}
+
+		// Latest grid only
+		select {
+		case <-grids:
+		default:
+		}
+		grids <- grid
+	}
+}
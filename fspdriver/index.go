@@ -1,66 +1,185 @@
 package fspdriver
 
 import (
-	"bufio"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"gocv.io/x/gocv"
 )
 
-func CameraPipeAndLoop(stateChan chan CameraState, imageTriggerChan chan bool, client mqtt.Client) error {
+// StartCameraPipeline runs CameraPipeAndLoop in background,
+// unless the camera pipeline is already active
+func (d *Driver) StartCameraPipeline() error {
+	d.pipelineMut.Lock()
+	defer d.pipelineMut.Unlock()
 
-	err := CalibrateExposure()
+	if d.ctx.Err() != nil {
+		return fmt.Errorf("driver is stopped")
+	}
+	if d.pipelineActive {
+		if state := d.getCameraState(); state == CAMERA_STATE_STOPPING {
+			return fmt.Errorf("camera is %s", state.String())
+		}
+		// Already starting or running
+		return nil
+	}
+	err := d.transitionCameraState(CAMERA_STATE_STARTING, "")
 	if err != nil {
-		ERRORLogger.Fatal(err)
+		return err
 	}
-	if LOG_LEVEL <= INFO_LEVEL {
-		INFOLogger.Printf("AEC completed. ShutterSpeed: %d, MaxValue: %d", AEC_EFFECTIVE_SHUTTER_SPEED, AEC_EFFECTIVE_MAX_VALUE)
+	ctx, cancel := context.WithCancel(d.ctx)
+	pipelineDone := make(chan bool)
+	d.pipelineActive = true
+	d.pipelineCancel = cancel
+	d.pipelineDone = pipelineDone
+
+	go func() {
+		d.CameraPipeAndLoop(ctx)
+		cancel()
+
+		d.pipelineMut.Lock()
+		defer d.pipelineMut.Unlock()
+		d.pipelineActive = false
+		if d.getCameraState() == CAMERA_STATE_STOPPING {
+			d.setCameraState(CAMERA_STATE_OFF, "")
+		}
+		close(pipelineDone)
+	}()
+	return err
+}
+
+// StopCameraPipeline cancels the active camera pipeline, whatever
+// the stage it is at (calibration included), and waits for it to return.
+// A failed camera is turned off
+func (d *Driver) StopCameraPipeline() error {
+	d.pipelineMut.Lock()
+	active := d.pipelineActive
+	cancel := d.pipelineCancel
+	pipelineDone := d.pipelineDone
+	d.pipelineMut.Unlock()
+
+	if active {
+		cancel()
+		select {
+		case <-pipelineDone:
+		case <-time.After(CAMERA_STATE_STOP_TIMEOUT):
+			return fmt.Errorf("timeout waiting for the camera to stop, camera is %s", d.getCameraState().String())
+		}
+	}
+	if d.getCameraState() == CAMERA_STATE_ERROR {
+		return d.transitionCameraState(CAMERA_STATE_OFF, "")
+	}
+	return nil
+}
+
+// failCameraPipeline puts the camera in error state with err as the reason,
+// unless err results from the cancellation of ctx
+func (d *Driver) failCameraPipeline(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Println("Camera pipeline cancelled")
+		}
+		d.setCameraState(CAMERA_STATE_STOPPING, "cancelled")
+		return ctx.Err()
 	}
+	if LOG_LEVEL <= ERROR_LEVEL {
+		ERRORLogger.Printf("Camera pipeline failed: %s", err.Error())
+	}
+	d.setCameraState(CAMERA_STATE_ERROR, err.Error())
+	return err
+}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+// CameraPipeAndLoop calibrates and starts the camera, then supervises
+// the main loop until ctx is cancelled, recalibrating on request.
+// Camera state is expected to be STARTING
+func (d *Driver) CameraPipeAndLoop(ctx context.Context) error {
 
-	cmd, stdoutReader := StartCamera(CAMERA_FRAMERATE_MUT, AEC_EFFECTIVE_SHUTTER_SPEED)
-	mat, err := SampleCamera(stdoutReader)
+	sourceCalibrated, err := d.applySourceCalibration()
 	if err != nil {
-		ERRORLogger.Fatal(err)
+		return d.failCameraPipeline(ctx, err)
+	}
+
+	var source FrameSource
+	if sourceCalibrated {
+		calibration := d.getCalibration()
+		source, err = d.StartCamera(d.getFramerate(), calibration.EffectiveShutterSpeed, calibration.EffectiveGain)
+	} else {
+		steps, _ := parseCalibrationSteps(CALIBRATION_DEFAULT_STEPS)
+		source, err = d.calibrateCamera(ctx, steps, nil)
 	}
-	_, err = CalibrateSpotsGrid(mat)
 	if err != nil {
-		ERRORLogger.Fatal(err)
+		return d.failCameraPipeline(ctx, err)
+	}
+	if ctx.Err() != nil {
+		StopCamera(source)
+		return d.failCameraPipeline(ctx, ctx.Err())
 	}
 
-	CalibrateDarkValue(mat)
-
-	mat.Close()
+	if d.options.RecordOnStart {
+		_, err = d.StartRecording("")
+		if err != nil {
+			if LOG_LEVEL <= ERROR_LEVEL {
+				ERRORLogger.Println(err)
+			}
+		}
+	}
 
-	go MainLoop(client, stdoutReader, imageTriggerChan)
+	d.setCameraState(CAMERA_STATE_RUNNING, "")
 
-	select {
-	case sig := <-signalChan: // Block until signal is received
-		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Println("Received SIGNAL:", sig.String())
-		}
-		StopCamera(cmd)
-		os.Exit(0)
+loop:
+	for {
+		supervisorCtx, cancelSupervisor := context.WithCancel(ctx)
+		supervisorDoneChan := make(chan bool)
+		go func(source FrameSource) {
+			d.SuperviseCamera(supervisorCtx, source)
+			close(supervisorDoneChan)
+		}(source)
 
-	case state := <-stateChan:
-		if state == 0 {
+		select {
+		case <-ctx.Done():
 			if LOG_LEVEL <= INFO_LEVEL {
-				INFOLogger.Println("Received OFF state")
+				INFOLogger.Println("Camera pipeline cancelled")
 			}
-			StopCamera(cmd)
-			signal.Stop(signalChan)
-			break
+			d.setCameraState(CAMERA_STATE_STOPPING, "")
+			<-supervisorDoneChan
+			cancelSupervisor()
+			break loop
+
+		case <-supervisorDoneChan:
+			cancelSupervisor()
+			d.setCameraState(CAMERA_STATE_STOPPING, "frame source reached its end")
+			break loop
+
+		case req := <-d.calibrationRequestChan:
+			// The supervisor stops the camera on return
+			cancelSupervisor()
+			<-supervisorDoneChan
+			if LOG_LEVEL <= INFO_LEVEL {
+				INFOLogger.Printf("Performing calibration: %s", calibrationStepsString(req.steps))
+			}
+			source, err = d.recalibrateCamera(ctx, req.steps, req.imagePaths)
+			req.resultChan <- err
+			if source == nil {
+				d.StopRecording()
+				return d.failCameraPipeline(ctx, err)
+			}
+			if ctx.Err() != nil {
+				StopCamera(source)
+				d.setCameraState(CAMERA_STATE_STOPPING, "cancelled")
+				break loop
+			}
+			d.setCameraState(CAMERA_STATE_RUNNING, "")
+		}
+	}
+	_, err = d.StopRecording()
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Println(err)
 		}
 	}
 	if LOG_LEVEL <= INFO_LEVEL {
@@ -69,14 +188,37 @@ func CameraPipeAndLoop(stateChan chan CameraState, imageTriggerChan chan bool, c
 	return err
 }
 
-func GetCameraStateHandler(client mqtt.Client, msg mqtt.Message) {
+// applySourceCalibration takes over the calibration carried by
+// the selected frame source (e.g. a recording), if any
+func (d *Driver) applySourceCalibration() (bool, error) {
+	source, err := NewFrameSource(d.options.FrameSource, d.options)
+	if err != nil {
+		return false, err
+	}
+	calibratedSource, ok := source.(CalibratedSource)
+	if !ok {
+		return false, err
+	}
+	calibration, err := calibratedSource.Calibration()
+	if err != nil {
+		return false, err
+	}
+	if len(calibration.EffectiveGrid) != d.layout.MMINodes() {
+		return false, fmt.Errorf("frame source %s grid has %d nodes, chip layout %s has %d", d.options.FrameSource, len(calibration.EffectiveGrid), d.layout.Name, d.layout.MMINodes())
+	}
+	d.setCalibration(calibration)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Using the calibration of frame source %s. ShutterSpeed: %d, DarkValue: %d", d.options.FrameSource, calibration.EffectiveShutterSpeed, calibration.EffectiveDarkValue)
+	}
+	return true, err
+}
+
+func (d *Driver) GetCameraStateHandler(client mqtt.Client, msg mqtt.Message) {
 	var err error
-	respTopic := getFullTopicString(CAMERA_GET_STATE_CB_MQTT_TOPIC_PATH)
+	respTopic := d.getFullTopicString(CAMERA_GET_STATE_CB_MQTT_TOPIC_PATH)
 
 	respObj := MQTTResponse{
-		Message: CameraStateMessage{
-			State: CAMERA_STATE_MUT,
-		},
+		Message: d.getCameraStateMessage(),
 	}
 	err = PublishJsonMsg(respTopic, respObj, client)
 	if err != nil {
@@ -86,64 +228,39 @@ func GetCameraStateHandler(client mqtt.Client, msg mqtt.Message) {
 	}
 }
 
-func SetCameraStateHandler(stateChan chan CameraState, imageTriggerChan chan bool) mqtt.MessageHandler {
-
-	var f = func(client mqtt.Client, msg mqtt.Message) {
-		var err error
-		respTopic := getFullTopicString(CAMERA_SET_STATE_CB_MQTT_TOPIC_PATH)
-
-		payload := msg.Payload()
-		var state CameraStateMessage
-		err = json.Unmarshal(payload, &state)
-		if err != nil {
-			if LOG_LEVEL <= ERROR_LEVEL {
-				ERRORLogger.Printf("Error occurred in SetCameraFramerateHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
-			}
-		}
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Printf("Setting CAMERA_STATE to %d", state.State)
-		}
-
-		switch state.State {
-
-		case 0:
-			stateChan <- 0
-		case 1:
-			if CAMERA_STATE_MUT != 0 {
-				if LOG_LEVEL <= WARNING_LEVEL {
-					WARNINGLogger.Println("Received SET_STATE=1 but camera is already in running state. Ignoring..")
-				}
-			}
-			go CameraPipeAndLoop(stateChan, imageTriggerChan, client)
-		default:
-			if LOG_LEVEL <= WARNING_LEVEL {
-				WARNINGLogger.Printf("Received invalid State value for CAMERA_STATE: %d. Must be either 0 either 1.", state.State)
-			}
-			return
-		}
+func (d *Driver) SetCameraStateHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_STATE_CB_MQTT_TOPIC_PATH)
 
-		respObj := MQTTResponse{
-			Message: CameraStateMessage{
-				State: CAMERA_STATE_MUT,
-			},
-		}
-		err = PublishJsonMsg(respTopic, respObj, client)
-		if err != nil {
-			if LOG_LEVEL <= ERROR_LEVEL {
-				ERRORLogger.Printf("Error occurred in SetCameraFramerateHandler MQTT CB: %s", err.Error())
-			}
+	payload := msg.Payload()
+	var state CameraStateMessage
+	err = json.Unmarshal(payload, &state)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetCameraStateHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
 		}
 	}
-	return f
+	d.submitCommand(command{
+		name:      fmt.Sprintf("SET_STATE=%d", state.State),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err != nil {
+				return d.getCameraStateMessage(), err
+			}
+			err := d.commandCameraState(state.State)
+			return d.getCameraStateMessage(), err
+		},
+	})
 }
 
-func GetCameraFramerateHandler(client mqtt.Client, msg mqtt.Message) {
+func (d *Driver) GetCameraFramerateHandler(client mqtt.Client, msg mqtt.Message) {
 	var err error
-	respTopic := getFullTopicString(CAMERA_GET_FRAMERATE_CB_MQTT_TOPIC_PATH)
+	respTopic := d.getFullTopicString(CAMERA_GET_FRAMERATE_CB_MQTT_TOPIC_PATH)
 
 	respObj := MQTTResponse{
 		Message: CameraFramerateMessage{
-			Framerate: CAMERA_FRAMERATE_MUT,
+			Framerate: d.getFramerate(),
 		},
 	}
 	err = PublishJsonMsg(respTopic, respObj, client)
@@ -154,137 +271,255 @@ func GetCameraFramerateHandler(client mqtt.Client, msg mqtt.Message) {
 	}
 }
 
-func SetCameraFramerateHandler(stateChan chan CameraState, imageTriggerChan chan bool) mqtt.MessageHandler {
-
-	var f = func(client mqtt.Client, msg mqtt.Message) {
-		var err error
-		respTopic := getFullTopicString(CAMERA_SET_FRAMERATE_CB_MQTT_TOPIC_PATH)
+func (d *Driver) SetCameraFramerateHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_FRAMERATE_CB_MQTT_TOPIC_PATH)
 
-		payload := msg.Payload()
-		var framerate CameraFramerateMessage
-		err = json.Unmarshal(payload, &framerate)
-		if err != nil {
-			if LOG_LEVEL <= ERROR_LEVEL {
-				ERRORLogger.Printf("Error occurred in SetCameraFramerateHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
-			}
-		}
-		
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Printf("Setting CAMERA_FRAMERATE to %d", framerate.Framerate)
+	payload := msg.Payload()
+	var framerate CameraFramerateMessage
+	err = json.Unmarshal(payload, &framerate)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetCameraFramerateHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
 		}
+	}
+	d.submitCommand(command{
+		name:      fmt.Sprintf("SET_FRAMERATE=%d", framerate.Framerate),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err == nil {
+				err = d.commandCameraFramerate(framerate.Framerate)
+			}
+			return CameraFramerateMessage{
+				Framerate: d.getFramerate(),
+			}, err
+		},
+	})
+}
 
-		CAMERA_FRAMERATE_MUT = framerate.Framerate
-
-		stateChan <- 0
-		go CameraPipeAndLoop(stateChan, imageTriggerChan, client)
+func (d *Driver) GetCalibrationHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_GET_CALIBRATION_CB_MQTT_TOPIC_PATH)
 
-		respObj := MQTTResponse{
-			Message: CameraFramerateMessage{
-				Framerate: CAMERA_FRAMERATE_MUT,
-			},
-		}
-		err = PublishJsonMsg(respTopic, respObj, client)
-		if err != nil {
-			if LOG_LEVEL <= ERROR_LEVEL {
-				ERRORLogger.Printf("Error occurred in SetCameraFramerateHandler MQTT CB: %s", err.Error())
-			}
+	respObj := MQTTResponse{
+		Message: d.getCalibration(),
+	}
+	err = PublishJsonMsg(respTopic, respObj, client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in GetCalibrationHandler MQTT CB: %s", err.Error())
 		}
 	}
-	return f
 }
 
-func GetCalibrationHandler(client mqtt.Client, msg mqtt.Message) {
+// GetConfigHandler replies with the effective configuration
+func (d *Driver) GetConfigHandler(client mqtt.Client, msg mqtt.Message) {
 	var err error
-	respTopic := getFullTopicString(CAMERA_GET_CALIBRATION_CB_MQTT_TOPIC_PATH)
+	respTopic := d.getFullTopicString(CAMERA_GET_CONFIG_CB_MQTT_TOPIC_PATH)
 
+	values := d.options.ConfigValues()
+	framerate := d.getFramerate()
+	for i, value := range values {
+		if value.Key == "framerate" && framerate != d.options.Framerate {
+			values[i].Value = framerate
+			values[i].Source = CONFIG_SOURCE_MQTT
+		}
+	}
 	respObj := MQTTResponse{
-		Message: CameraCalibrationMessage{
-			TargetMaxValue:        AEC_MAX_VALUE_TARGET,
-			EffectiveMaxValue:     AEC_EFFECTIVE_MAX_VALUE,
-			EffectiveShutterSpeed: AEC_EFFECTIVE_SHUTTER_SPEED,
-			EffectiveDarkValue:    AEC_EFFECTIVE_DARK_VALUE,
-			EffectiveGrid:         NODE_DETECTION_EFFECTIVE_GRID,
+		Message: ConfigMessage{
+			Values: values,
 		},
 	}
 	err = PublishJsonMsg(respTopic, respObj, client)
 	if err != nil {
 		if LOG_LEVEL <= ERROR_LEVEL {
-			ERRORLogger.Printf("Error occurred in GetCalibrationHandler MQTT CB: %s", err.Error())
+			ERRORLogger.Printf("Error occurred in GetConfigHandler MQTT CB: %s", err.Error())
 		}
 	}
 }
 
-func GetImageHandler(stateChan chan CameraState, imageTriggerChan chan bool) mqtt.MessageHandler {
-
-	var f = func(client mqtt.Client, msg mqtt.Message) {
-		imageTriggerChan <- true
+func (d *Driver) GetImageHandler(client mqtt.Client, msg mqtt.Message) {
+	select {
+	case d.imageTriggerChan <- true:
+	default:
+		// An image is already requested
 	}
-	return f
 }
 
-func SetupMQTTSubscriptionCallbacks(stateChan chan CameraState, imageTriggerChan chan bool, client mqtt.Client) {
+func (d *Driver) setupMQTTSubscriptionCallbacks() {
 	var topic string
+	client := d.client
 
 	// State
-	topic = getFullTopicString(CAMERA_GET_STATE_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_GET_STATE_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera GET_STATE: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, GetCameraStateHandler)
+	client.Subscribe(topic, DEFAULT_QOS, d.GetCameraStateHandler)
 
-	topic = getFullTopicString(CAMERA_SET_STATE_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_SET_STATE_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera SET_STATE: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, SetCameraStateHandler(stateChan, imageTriggerChan))
+	client.Subscribe(topic, DEFAULT_QOS, d.SetCameraStateHandler)
 
 	// Framerate
-	topic = getFullTopicString(CAMERA_GET_FRAMERATE_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_GET_FRAMERATE_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera GET_FRAMERATE: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, GetCameraFramerateHandler)
+	client.Subscribe(topic, DEFAULT_QOS, d.GetCameraFramerateHandler)
 
-	topic = getFullTopicString(CAMERA_SET_FRAMERATE_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_SET_FRAMERATE_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera SET_FRAMERATE: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, SetCameraFramerateHandler(stateChan, imageTriggerChan))
+	client.Subscribe(topic, DEFAULT_QOS, d.SetCameraFramerateHandler)
 
 	// Calibration
-	topic = getFullTopicString(CAMERA_GET_CALIBRATION_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_GET_CALIBRATION_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera GET_CALIBRATION: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, GetCalibrationHandler)
-	// Calibration is performed on each SET_CAMERA=1, no need to implement a separate command
+	client.Subscribe(topic, DEFAULT_QOS, d.GetCalibrationHandler)
+
+	topic = d.getFullTopicString(CAMERA_PERFORM_CALIBRATION_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera PERFORM_CALIBRATION: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.PerformCalibrationHandler)
+
+	// Exposure
+	topic = d.getFullTopicString(CAMERA_GET_EXPOSURE_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera GET_EXPOSURE: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.GetExposureHandler)
+
+	topic = d.getFullTopicString(CAMERA_SET_EXPOSURE_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera SET_EXPOSURE: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.SetExposureHandler)
+
+	// Flat field
+	topic = d.getFullTopicString(CAMERA_GET_FLAT_FIELD_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera GET_FLAT_FIELD: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.GetFlatFieldHandler)
+
+	topic = d.getFullTopicString(CAMERA_SET_FLAT_FIELD_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera SET_FLAT_FIELD: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.SetFlatFieldHandler)
+
+	// Spots grid
+	topic = d.getFullTopicString(CAMERA_GET_GRID_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera GET_GRID: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.GetSpotsGridHandler)
+
+	topic = d.getFullTopicString(CAMERA_SET_GRID_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera SET_GRID: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.SetSpotsGridHandler)
+
+	// Config
+	topic = d.getFullTopicString(CAMERA_GET_CONFIG_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera GET_CONFIG: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.GetConfigHandler)
+
+	// Recording
+	topic = d.getFullTopicString(CAMERA_GET_RECORDING_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera GET_RECORDING: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.GetRecordingHandler)
+
+	topic = d.getFullTopicString(CAMERA_SET_RECORDING_MQTT_TOPIC_PATH)
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Subscribing to Camera SET_RECORDING: %s", topic)
+	}
+	client.Subscribe(topic, DEFAULT_QOS, d.SetRecordingHandler)
 
 	// Image
-	topic = getFullTopicString(CAMERA_GET_IMAGE_MQTT_TOPIC_PATH)
+	topic = d.getFullTopicString(CAMERA_GET_IMAGE_MQTT_TOPIC_PATH)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Subscribing to Camera GET_IMAGE: %s", topic)
 	}
-	client.Subscribe(topic, DEFAULT_QOS, GetImageHandler(stateChan, imageTriggerChan))
+	client.Subscribe(topic, DEFAULT_QOS, d.GetImageHandler)
 
 }
 
-func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bool) error {
+// MainLoop extracts and publishes the MMI/MZI values of each frame
+// until the source fails or ctx is cancelled
+func (d *Driver) MainLoop(ctx context.Context, source FrameSource) error {
 
-	r := bufio.NewReader(reader)
 	t0 := time.Now()
 
-	w := CAMERA_FRAME_WIDTH
-	h := CAMERA_FRAME_HEIGHT
+	w := d.options.FrameWidth
+	h := d.options.FrameHeight
+	radius := d.options.Extraction.EllipseRadius
+
+	nMZIs := d.layout.MZINodes()
+	nMMIs := d.layout.MMINodes()
 
-	var firstMZIs [MZI_N_NODES]float64
-	var previousMZIs [MZI_N_NODES]float64
-	var unwindedMZIs [MZI_N_NODES]float64
-	var Ks [MZI_N_NODES]int
+	var firstMZIs []float64
+	var previousMZIs []float64
+	unwindedMZIs := make([]float64, nMZIs)
+	Ks := make([]int, nMZIs)
 
 	var firstMZIsAcquired bool
+	var firstFrameTs time.Time
+
+	groundTruthSource, hasGroundTruth := unwrapFrameSource(source).(GroundTruthSource)
 
-	grid := NODE_DETECTION_EFFECTIVE_GRID
-	darkValue := AEC_EFFECTIVE_DARK_VALUE
+	calibration := d.getCalibration()
+
+	// Exposure is tracked unless pinned manually
+	var exposureTracker *ExposureTracker
+	exposureController, canControlExposure := unwrapFrameSource(source).(ExposureController)
+	if d.options.ExposureTracking.Enabled && canControlExposure && !calibration.ManualExposure {
+		exposureTracker = NewExposureTracker(d.options.ExposureTracking, d.options.AEC, calibration.ReferenceSpotLevel)
+	}
+	var exposureChanged bool
+	grid := calibration.EffectiveGrid
+	// Grid follows the spots drift, if tracked
+	var gridFrames chan gridTrackerFrame
+	var trackedGrids chan []GridNode
+	if d.options.GridTracking.Enabled {
+		gridFrames = make(chan gridTrackerFrame)
+		trackedGrids = make(chan []GridNode, 1)
+		gridTracker := NewGridTracker(d.options.GridTracking, d.options.Extraction, grid)
+		trackerCtx, stopTracker := context.WithCancel(ctx)
+		trackerDone := make(chan struct{})
+		go func() {
+			d.runGridTracker(trackerCtx, gridTracker, calibration.EffectiveGridGeometry, gridFrames, trackedGrids)
+			close(trackerDone)
+		}()
+		// No write back once the loop returned, the grid may be set meanwhile
+		defer func() {
+			stopTracker()
+			<-trackerDone
+		}()
+	}
+	darkValue := calibration.EffectiveDarkValue
+	// Extraction works on the dark frame subtracted luma plane, if any
+	darkFrame := d.getDarkFrame()
+	var correctedBuf []byte
+	if darkFrame != nil {
+		correctedBuf = make([]byte, w*h)
+	}
+	flatFieldGains := d.getFlatFieldGains()
+	framerate := d.getFramerate()
+	client := d.client
 
 	// mzif, err := os.Create("mzis.csv")
 	// if err != nil {
@@ -305,15 +540,26 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 	// 1/2 chroma plane
 	// http://www.chiark.greenend.org.uk/doc/linux-doc-3.16/html/media_api/re29.html
 
-	fullBuf := make([]byte, w*h+w*h/2)
-
-	MZIShiftsAccumulatorTs := time.Now()
+	var MZIShiftsAccumulatorTs time.Time
 
-	var MZIShiftsAccumulator [MZI_N_NODES]float64
+	MZIShiftsAccumulator := make([]float64, nMZIs)
 	var MZIShiftsAccumulatorCount int
+	var MZIShiftsAccumulatorExposureChanged bool
+	var MZIShiftsAccumulatorQuality uint32
+	MZIsAccumulatorQuality := make([]uint32, nMZIs)
+	MMIsAccumulatorQuality := make([]uint32, nMMIs)
+	// MZI flags of the last quality alert
+	alertedMZIsQuality := make([]uint32, nMZIs)
 
 	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, fullBuf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fullBuf, frameTs, err := source.NextFrame()
+		if ctx.Err() != nil {
+			// Source is closed on cancellation
+			return ctx.Err()
+		}
 		if err != nil {
 			return err
 		}
@@ -322,16 +568,58 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 				INFOLogger.Printf("Time until first frame arrived: %s", time.Since(t0).String())
 			}
 			t0 = time.Now()
+			MZIShiftsAccumulatorTs = frameTs
 		}
 
 		buf := fullBuf[:w*h]
 
-		MMIs := ExtractMMIsBuffer(buf, grid, darkValue)
-		MZIs := ExtractMZIsIndexed(MMIs, grid)
+		d.recordFrame(buf, frameTs)
+
+		extractionBuf := buf
+		if darkFrame != nil {
+			SubtractDarkFrame(correctedBuf, buf, darkFrame)
+			extractionBuf = correctedBuf
+		}
+		MMIs, MMIStats := ExtractMMIsBufferStats(extractionBuf, w, h, grid, darkValue, radius)
+		ApplyFlatField(MMIs, flatFieldGains, darkValue)
+		MZIs := ExtractMZIsIndexed(MMIs, d.layout)
+
+		mmiQualities := MMIsQuality(MMIStats, darkValue, d.options.Extraction)
+		mziQualities := MZIsQuality(mmiQualities, d.layout)
+		var frameQuality uint32
+		for n, quality := range mmiQualities {
+			frameQuality |= quality
+			MMIsAccumulatorQuality[n] |= quality
+		}
+		for n, quality := range mziQualities {
+			MZIsAccumulatorQuality[n] |= quality
+		}
+
+		// The frame following an adjustment is the first one acquired with the new exposure
+		frameExposureChanged := exposureChanged
+		exposureChanged = false
+		if exposureTracker != nil {
+			exposureChanged = d.trackExposure(exposureTracker, exposureController, MMIs)
+		}
+		if gridFrames != nil {
+			select {
+			case grid = <-trackedGrids:
+			default:
+			}
+			if i%d.options.GridTracking.Interval == d.options.GridTracking.Interval-1 {
+				// Skipped while the previous estimate runs
+				frame := gridTrackerFrame{buf: append([]byte(nil), extractionBuf...), i: i, timestamp: int(frameTs.UnixMilli())}
+				select {
+				case gridFrames <- frame:
+				default:
+				}
+			}
+		}
 
 		if !firstMZIsAcquired {
 			firstMZIs = MZIs
 			previousMZIs = MZIs
+			firstFrameTs = frameTs
 			firstMZIsAcquired = true
 			continue
 		}
@@ -353,12 +641,14 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 
 		previousMZIs = MZIs
 
-		var MZIShifts [MZI_N_NODES]float64
+		MZIShifts := make([]float64, nMZIs)
 		for i, mzi := range unwindedMZIs {
 			MZIShifts[i] = mzi - firstMZIs[i]
 		}
 
-		durationSinceLastMZIShiftsBuffer := time.Since(MZIShiftsAccumulatorTs)
+		// Frame timestamps are used (rather than the wall clock)
+		// for the replays to be deterministic
+		durationSinceLastMZIShiftsBuffer := frameTs.Sub(MZIShiftsAccumulatorTs)
 		// Accumulate MZI values during bufferred period
 		if LOG_LEVEL <= DEBUG_LEVEL {
 			DEBUGLogger.Println("Accumulating master", durationSinceLastMZIShiftsBuffer.String())
@@ -367,12 +657,14 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 			MZIShiftsAccumulator[i] += mziValue
 		}
 		MZIShiftsAccumulatorCount++
-		if durationSinceLastMZIShiftsBuffer.Milliseconds() < int64(1000/MZI_EXTRACTION_FRAMERATE_MUT)-int64(1000/CAMERA_FRAMERATE_MUT) {
+		MZIShiftsAccumulatorExposureChanged = MZIShiftsAccumulatorExposureChanged || frameExposureChanged
+		MZIShiftsAccumulatorQuality |= frameQuality
+		if durationSinceLastMZIShiftsBuffer.Milliseconds() < int64(1000/d.options.MZIExtractionFramerate)-int64(1000/framerate) {
 			continue
 		}
 		// Calculate the master (mean) mzi shifts
 		// accumulated during the bufferred period
-		var MZIShiftsMaster [MMI_N_NODES]float64
+		MZIShiftsMaster := make([]float64, nMZIs)
 		for i, mziValue := range MZIShiftsAccumulator {
 			MZIShiftsMaster[i] = mziValue / float64(MZIShiftsAccumulatorCount)
 		}
@@ -390,23 +682,36 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 		}
 
 		// Reset the accumulator and the counter
-		MZIShiftsAccumulatorTs = time.Now()
+		MZIShiftsAccumulatorTs = frameTs
 		MZIShiftsAccumulatorCount = 0
 		for i := range MZIShiftsAccumulator {
 			MZIShiftsAccumulator[i] = 0
 		}
+		accumulatedExposureChanged := MZIShiftsAccumulatorExposureChanged
+		MZIShiftsAccumulatorExposureChanged = false
+		accumulatedQuality := MZIShiftsAccumulatorQuality
+		MZIShiftsAccumulatorQuality = 0
+
+		ts := int(frameTs.UnixMilli())
+		if !equalQualities(MZIsAccumulatorQuality, alertedMZIsQuality) {
+			d.publishQualityAlert(i, ts, MZIsAccumulatorQuality, MMIsAccumulatorQuality)
+			copy(alertedMZIsQuality, MZIsAccumulatorQuality)
+		}
+		MZIsAccumulatorQuality = make([]uint32, nMZIs)
+		MMIsAccumulatorQuality = make([]uint32, nMMIs)
 
 		// WriteCSV(csvWMMI, MMIs[:])
 		// WriteCSV(csvWMZI, MZIShifts[:])
 
-		ts := int(time.Now().UnixMilli())
 		// Publish MZISfifts Frame
 		mziShiftsFrame := Frame{
-			I:         i,
-			Timestamp: ts,
-			Values:    MZIShifts[:],
+			I:               i,
+			Timestamp:       ts,
+			Values:          MZIShifts,
+			ExposureChanged: accumulatedExposureChanged,
+			Quality:         accumulatedQuality,
 		}
-		topicMZI := getFullTopicString(CAMERA_MZI_BROADCAST_MQTT_TOPIC_PATH)
+		topicMZI := d.getFullTopicString(CAMERA_MZI_BROADCAST_MQTT_TOPIC_PATH)
 		err = PublishJsonMsg(topicMZI, mziShiftsFrame, client)
 		if err != nil {
 			if LOG_LEVEL <= ERROR_LEVEL {
@@ -414,13 +719,50 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 			}
 		}
 
+		if hasGroundTruth {
+			// Publish the injected MZI shifts for comparison
+			truthMZIs := groundTruthSource.MZIPhases(frameTs)
+			firstTruthMZIs := groundTruthSource.MZIPhases(firstFrameTs)
+			truthMZIShifts := make([]float64, nMZIs)
+			var squaredErrorAcc float64
+			for i := range truthMZIShifts {
+				truthMZIShifts[i] = truthMZIs[i] - firstTruthMZIs[i]
+				squaredErrorAcc += math.Pow(MZIShifts[i]-truthMZIShifts[i], 2)
+			}
+			if LOG_LEVEL <= DEBUG_LEVEL {
+				DEBUGLogger.Printf("I: %d; MZI shifts RMS error vs ground truth: %.4f rad", i, math.Sqrt(squaredErrorAcc/float64(len(truthMZIShifts))))
+			}
+			truthFrame := Frame{
+				I:         i,
+				Timestamp: ts,
+				Values:    truthMZIShifts,
+			}
+			topicTruth := d.getFullTopicString(CAMERA_SIMULATOR_MZI_BROADCAST_MQTT_TOPIC_PATH)
+			err = PublishJsonMsg(topicTruth, truthFrame, client)
+			if err != nil {
+				if LOG_LEVEL <= ERROR_LEVEL {
+					ERRORLogger.Println(err)
+				}
+			}
+		}
+
 		// Publish MMIs Frame
-		mmiFrame := Frame{
-			I:         i,
-			Timestamp: ts,
-			Values:    MMIs[:],
+		peaks := make([]int, len(MMIStats))
+		saturation := make([]float64, len(MMIStats))
+		for n, stats := range MMIStats {
+			peaks[n] = int(stats.Peak)
+			saturation[n] = stats.SaturatedFraction
 		}
-		topicMMI := getFullTopicString(CAMERA_MZI_BROADCAST_MQTT_TOPIC_PATH)
+		mmiFrame := Frame{
+			I:               i,
+			Timestamp:       ts,
+			Values:          MMIs,
+			ExposureChanged: frameExposureChanged,
+			Quality:         frameQuality,
+			Peaks:           peaks,
+			Saturation:      saturation,
+		}
+		topicMMI := d.getFullTopicString(CAMERA_MZI_BROADCAST_MQTT_TOPIC_PATH)
 		err = PublishJsonMsg(topicMMI, mmiFrame, client)
 		if err != nil {
 			if LOG_LEVEL <= ERROR_LEVEL {
@@ -428,9 +770,9 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 			}
 		}
 		select {
-		case <-imageTriggerChan:
+		case <-d.imageTriggerChan:
 			// Raw image
-			topicImage := getFullTopicString(CAMERA_GET_IMAGE_CB_MQTT_TOPIC_PATH)
+			topicImage := d.getFullTopicString(CAMERA_GET_IMAGE_CB_MQTT_TOPIC_PATH)
 			mat, err := gocv.NewMatFromBytes(h, w, gocv.MatTypeCV8UC1, buf)
 			if err != nil {
 				if LOG_LEVEL <= ERROR_LEVEL {
@@ -452,9 +794,9 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 			drawingMat := gocv.NewMatWithSize(h, w, gocv.MatTypeCV8UC1)
 			mat.CopyTo(&drawingMat)
 			gocv.CvtColor(drawingMat, &drawingMat, gocv.ColorGrayToBGR)
-			DrawSpotsgridDebug(drawingMat, grid)
+			DrawSpotsgridDebug(drawingMat, grid, d.layout, radius)
 
-			topicDrawing := getFullTopicString(CAMERA_GET_DRAWING_CB_MQTT_TOPIC_PATH)
+			topicDrawing := d.getFullTopicString(CAMERA_GET_DRAWING_CB_MQTT_TOPIC_PATH)
 			err = PublishImage(topicDrawing, drawingMat, client)
 			drawingMat.Close()
 			if err != nil {
@@ -468,6 +810,67 @@ func MainLoop(client mqtt.Client, reader io.ReadCloser, imageTriggerChan chan bo
 	}
 }
 
+// publishQualityAlert publishes the MZIs with a compromised input
+func (d *Driver) publishQualityAlert(i, ts int, mziQualities []uint32, mmiQualities []uint32) {
+	alert := QualityAlertMessage{
+		I:         i,
+		Timestamp: ts,
+		MZIs:      []MZIQualityAlert{},
+	}
+	for mzi, quality := range mziQualities {
+		if quality == 0 {
+			continue
+		}
+		mmiIndices := d.layout.MZIMMIIndices[mzi]
+		alert.MZIs = append(alert.MZIs, MZIQualityAlert{
+			MZI:        mzi,
+			Label:      d.layout.MZIs[mzi].Label,
+			Quality:    quality,
+			MMIs:       mmiIndices,
+			MMIQuality: [3]uint32{mmiQualities[mmiIndices[0]], mmiQualities[mmiIndices[1]], mmiQualities[mmiIndices[2]]},
+		})
+	}
+	if LOG_LEVEL <= WARNING_LEVEL {
+		WARNINGLogger.Printf("Quality alert: %d compromised MZIs", len(alert.MZIs))
+	}
+	err := PublishJsonMsg(d.getFullTopicString(CAMERA_QUALITY_ALERT_MQTT_TOPIC_PATH), alert, d.client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing quality alert: %s", err.Error())
+		}
+	}
+}
+
+// trackExposure feeds the tracker with the frame MMIs and applies
+// the adjusted shutter speed to the running source, if due.
+// Returns whether the exposure changed
+func (d *Driver) trackExposure(tracker *ExposureTracker, controller ExposureController, MMIs []float64) bool {
+	calibration := d.getCalibration()
+	shutter, adjust := tracker.Update(MMIs, calibration.EffectiveShutterSpeed)
+	if tracker.Reference() != calibration.ReferenceSpotLevel {
+		d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+			calibration.ReferenceSpotLevel = tracker.Reference()
+		})
+	}
+	if !adjust {
+		return false
+	}
+	err := controller.SetExposure(shutter, calibration.EffectiveGain)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while adjusting the exposure: %s", err.Error())
+		}
+		return false
+	}
+	d.updateCalibration(func(calibration *CameraCalibrationMessage) {
+		calibration.EffectiveShutterSpeed = shutter
+	})
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Exposure adjusted. ShutterSpeed: %d -> %d", calibration.EffectiveShutterSpeed, shutter)
+	}
+	return true
+}
+
 func WriteCSV(csvW *csv.Writer, values []float64) {
 	var valuesStrings []string = make([]string, len(values))
 	for i, mzi := range values {
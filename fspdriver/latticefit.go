@@ -0,0 +1,575 @@
+package fspdriver
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// Grid reconstruction methods, see NodeDetectionOptions.LatticeFit.
+	// Projection: rotation and 1D projection borders only.
+	// Affine: least-squares affine map of the layout [row, col] onto the contours,
+	// starting from the projection grid, optionally with a radial distortion term.
+	// RANSAC: affine map starting from the lattice inferred robustly to missing
+	// and extra contours, see inferLattice
+	LATTICE_FIT_PROJECTION    = "projection"
+	LATTICE_FIT_AFFINE        = "affine"
+	LATTICE_FIT_AFFINE_RADIAL = "affine_radial"
+	LATTICE_FIT_RANSAC        = "ransac"
+
+	// Default of NodeDetectionOptions.LatticeFit
+	LATTICE_FIT = LATTICE_FIT_PROJECTION
+
+	// Contour to node assignment and fit rounds
+	LATTICE_FIT_MAX_ITERATIONS = 10
+	// Min contours assigned for the fit to be taken
+	LATTICE_FIT_MIN_NODES = 6
+
+	// Lattice line hypotheses drawn per axis, see fitLattice1D
+	LATTICE_RANSAC_ITERATIONS = 500
+	// Max distance of an inlier to its lattice line, relative to the pitch
+	LATTICE_RANSAC_TOLERANCE = 0.2
+	// Seed of the hypotheses draw, for the detections to be reproducible
+	LATTICE_RANSAC_SEED = 1
+	// Min population of the border lines, relative to the median line one
+	LATTICE_RANSAC_MIN_LINE_POPULATION = 0.25
+)
+
+var LATTICE_FITS = []string{LATTICE_FIT_PROJECTION, LATTICE_FIT_AFFINE, LATTICE_FIT_AFFINE_RADIAL, LATTICE_FIT_RANSAC}
+
+// GridAffine maps the layout [row, col] onto the image:
+// x = X0 + XCol*col + XRow*row, y = Y0 + YCol*col + YRow*row,
+// then scaled by 1 + RadialK1*r^2 around the grid center (CenterX, CenterY),
+// r being the distance to the center relative to RadialNorm
+type GridAffine struct {
+	X0   float64
+	XCol float64
+	XRow float64
+	Y0   float64
+	YCol float64
+	YRow float64
+
+	RadialK1   float64
+	CenterX    float64
+	CenterY    float64
+	RadialNorm float64
+}
+
+func (a GridAffine) undistorted(row, col int) (float64, float64) {
+	return a.X0 + a.XCol*float64(col) + a.XRow*float64(row),
+		a.Y0 + a.YCol*float64(col) + a.YRow*float64(row)
+}
+
+// Place returns the image position of the layout node at row, col
+func (a GridAffine) Place(row, col int) (float64, float64) {
+	x, y := a.undistorted(row, col)
+	if a.RadialK1 == 0 {
+		return x, y
+	}
+	dx := x - a.CenterX
+	dy := y - a.CenterY
+	factor := 1 + a.RadialK1*(dx*dx+dy*dy)/(a.RadialNorm*a.RadialNorm)
+	return a.CenterX + dx*factor, a.CenterY + dy*factor
+}
+
+// AngleDeg is the angle of the grid rows (col axis) on the image
+func (a GridAffine) AngleDeg() float64 {
+	return rad2Deg(math.Atan2(a.YCol, a.XCol))
+}
+
+// latticeFitResult reports the fit quality over the contours assigned to a node
+type latticeFitResult struct {
+	affine      GridAffine
+	nodes       int
+	iterations  int
+	residualRMS float64
+	residualMax float64
+}
+
+// solveLinear solves a*x = b by Gaussian elimination with partial pivoting
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	m := make([][]float64, n)
+	for i := range a {
+		m[i] = append(append([]float64(nil), a[i]...), b[i])
+	}
+	for col := 0; col < n; col++ {
+		pivotRow := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivotRow][col]) {
+				pivotRow = row
+			}
+		}
+		if math.Abs(m[pivotRow][col]) < 1e-12 {
+			return nil, fmt.Errorf("singular system")
+		}
+		m[col], m[pivotRow] = m[pivotRow], m[col]
+		for row := col + 1; row < n; row++ {
+			factor := m[row][col] / m[col][col]
+			for k := col; k <= n; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		acc := m[row][n]
+		for k := row + 1; k < n; k++ {
+			acc -= m[row][k] * x[k]
+		}
+		x[row] = acc / m[row][row]
+	}
+	return x, nil
+}
+
+// fitAffine fits the affine map of the layout nodes onto the points by least squares
+func fitAffine(nodes []GridNode, points [][2]float64) (GridAffine, error) {
+	var affine GridAffine
+	normal := [][]float64{make([]float64, 3), make([]float64, 3), make([]float64, 3)}
+	bx := make([]float64, 3)
+	by := make([]float64, 3)
+	for i, node := range nodes {
+		v := [3]float64{1, float64(node.Col), float64(node.Row)}
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				normal[j][k] += v[j] * v[k]
+			}
+			bx[j] += v[j] * points[i][0]
+			by[j] += v[j] * points[i][1]
+		}
+	}
+	xs, err := solveLinear(normal, bx)
+	if err != nil {
+		return affine, err
+	}
+	ys, err := solveLinear(normal, by)
+	if err != nil {
+		return affine, err
+	}
+	affine.X0, affine.XCol, affine.XRow = xs[0], xs[1], xs[2]
+	affine.Y0, affine.YCol, affine.YRow = ys[0], ys[1], ys[2]
+	return affine, nil
+}
+
+// fitAffineRadial fits the affine map and the radial distortion of the layout nodes
+// onto the points by least squares, jointly: the distortion term k1*r^2*(p - c) is
+// taken at the undistorted positions estimated so far, so that repeated fits converge
+// (Gauss-Newton) instead of the affine map absorbing the distortion as scale
+func fitAffineRadial(nodes []GridNode, points [][2]float64, undistorted [][2]float64, centerX, centerY, radialNorm float64) (GridAffine, error) {
+	affine := GridAffine{CenterX: centerX, CenterY: centerY, RadialNorm: radialNorm}
+	// X0, XCol, XRow, Y0, YCol, YRow, k1
+	normal := make([][]float64, 7)
+	for j := range normal {
+		normal[j] = make([]float64, 7)
+	}
+	b := make([]float64, 7)
+	for i, node := range nodes {
+		dx := undistorted[i][0] - centerX
+		dy := undistorted[i][1] - centerY
+		r2 := (dx*dx + dy*dy) / (radialNorm * radialNorm)
+		vx := [7]float64{1, float64(node.Col), float64(node.Row), 0, 0, 0, r2 * dx}
+		vy := [7]float64{0, 0, 0, 1, float64(node.Col), float64(node.Row), r2 * dy}
+		for j := 0; j < 7; j++ {
+			for k := 0; k < 7; k++ {
+				normal[j][k] += vx[j]*vx[k] + vy[j]*vy[k]
+			}
+			b[j] += vx[j]*points[i][0] + vy[j]*points[i][1]
+		}
+	}
+	x, err := solveLinear(normal, b)
+	if err != nil {
+		return affine, err
+	}
+	affine.X0, affine.XCol, affine.XRow = x[0], x[1], x[2]
+	affine.Y0, affine.YCol, affine.YRow = x[3], x[4], x[5]
+	affine.RadialK1 = x[6]
+	return affine, nil
+}
+
+// fitLattice refines the initial grid (indexed as the layout) into an affine
+// lattice (with radial distortion if radial) fitted on the detected contours.
+// Each round assigns the contours to their nearest predicted node within maxDistance,
+// at most half the smallest node spacing (0 for the latter), then refits
+func fitLattice(detectedGridNodes []GridNode, initial []GridNode, radial bool, maxDistance float64) (latticeFitResult, error) {
+	var result latticeFitResult
+
+	// Assignment radius: at most half the smallest spacing of the initial grid
+	minSpacing := math.MaxFloat64
+	for i := range initial {
+		for j := i + 1; j < len(initial); j++ {
+			minSpacing = math.Min(minSpacing, math.Hypot(initial[i].X-initial[j].X, initial[i].Y-initial[j].Y))
+		}
+	}
+	if maxDistance <= 0 || maxDistance > minSpacing/2 {
+		maxDistance = minSpacing / 2
+	}
+
+	var centerX, centerY, radialNorm float64
+	for _, node := range initial {
+		centerX += node.X / float64(len(initial))
+		centerY += node.Y / float64(len(initial))
+	}
+	for _, node := range initial {
+		radialNorm = math.Max(radialNorm, math.Hypot(node.X-centerX, node.Y-centerY))
+	}
+
+	predicted := initial
+	var previousAssignment []int
+	var previousK1 float64
+	for iteration := 1; iteration <= LATTICE_FIT_MAX_ITERATIONS; iteration++ {
+		// Nearest contour of each node
+		assignment := make([]int, len(predicted))
+		distances := make([]float64, len(predicted))
+		for n := range assignment {
+			assignment[n] = -1
+			distances[n] = maxDistance
+		}
+		for c, detected := range detectedGridNodes {
+			nearest := -1
+			nearestDistance := maxDistance
+			for n, node := range predicted {
+				distance := math.Hypot(detected.X-node.X, detected.Y-node.Y)
+				if distance < nearestDistance {
+					nearest, nearestDistance = n, distance
+				}
+			}
+			if nearest >= 0 && nearestDistance < distances[nearest] {
+				assignment[nearest] = c
+				distances[nearest] = nearestDistance
+			}
+		}
+
+		var nodes []GridNode
+		var points [][2]float64
+		var undistorted [][2]float64
+		var contours []GridNode
+		for n, c := range assignment {
+			if c < 0 {
+				continue
+			}
+			// Undistorted node position of the previous round, the initial one first
+			position := [2]float64{initial[n].X, initial[n].Y}
+			if iteration > 1 {
+				position[0], position[1] = result.affine.undistorted(initial[n].Row, initial[n].Col)
+			}
+			nodes = append(nodes, initial[n])
+			points = append(points, [2]float64{detectedGridNodes[c].X, detectedGridNodes[c].Y})
+			undistorted = append(undistorted, position)
+			contours = append(contours, detectedGridNodes[c])
+		}
+		if len(nodes) < LATTICE_FIT_MIN_NODES {
+			return result, fmt.Errorf("lattice fit: %d contours within %.1f px of a node, %d required", len(nodes), maxDistance, LATTICE_FIT_MIN_NODES)
+		}
+		var affine GridAffine
+		var err error
+		if radial {
+			affine, err = fitAffineRadial(nodes, points, undistorted, centerX, centerY, radialNorm)
+		} else {
+			affine, err = fitAffine(nodes, points)
+			affine.CenterX = centerX
+			affine.CenterY = centerY
+			affine.RadialNorm = radialNorm
+		}
+		if err != nil {
+			return result, fmt.Errorf("lattice fit: %w", err)
+		}
+
+		predicted = make([]GridNode, len(initial))
+		for n, node := range initial {
+			x, y := affine.Place(node.Row, node.Col)
+			predicted[n] = GridNode{X: x, Y: y, Row: node.Row, Col: node.Col}
+		}
+		result.affine = affine
+		result.nodes = len(nodes)
+		result.iterations = iteration
+
+		// Residuals of the assigned contours to the fitted nodes
+		var squaredAcc float64
+		result.residualMax = 0
+		for i, node := range nodes {
+			x, y := affine.Place(node.Row, node.Col)
+			residual := math.Hypot(contours[i].X-x, contours[i].Y-y)
+			squaredAcc += residual * residual
+			result.residualMax = math.Max(result.residualMax, residual)
+		}
+		result.residualRMS = math.Sqrt(squaredAcc / float64(len(nodes)))
+
+		// Distortion is converged once its change no longer moves the nodes by 0.01 px
+		radialConverged := !radial || math.Abs(affine.RadialK1-previousK1) < 0.01/radialNorm
+		if equalInts(assignment, previousAssignment) && radialConverged {
+			break
+		}
+		previousAssignment = assignment
+		previousK1 = affine.RadialK1
+	}
+	return result, nil
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lattice1D is the positions of the lines (columns or rows) of a lattice along
+// an axis: origin + index*pitch, and the line index of the values lying on one
+type lattice1D struct {
+	origin  float64
+	pitch   float64
+	indices []int
+	inlier  []bool
+	inliers int
+	// Indices of the first and last lines with a value
+	first int
+	last  int
+	// Mean distance of the inliers to their line, relative to the pitch
+	residual float64
+}
+
+// scoreLattice1D indexes the values within LATTICE_RANSAC_TOLERANCE pitch of a line
+// of the origin, pitch lattice, keeping those on the lines consecutive lines most of them lie on
+func scoreLattice1D(values []float64, origin, pitch float64, lines int) lattice1D {
+	l := lattice1D{
+		origin:  origin,
+		pitch:   pitch,
+		indices: make([]int, len(values)),
+		inlier:  make([]bool, len(values)),
+	}
+	var indices []int
+	for i, value := range values {
+		index := math.Round((value - origin) / pitch)
+		if math.Abs(value-origin-index*pitch) < LATTICE_RANSAC_TOLERANCE*pitch {
+			l.indices[i] = int(index)
+			l.inlier[i] = true
+			indices = append(indices, int(index))
+		}
+	}
+	if len(indices) == 0 {
+		return l
+	}
+
+	// Best window of lines consecutive lines
+	sort.Ints(indices)
+	var windowStart, windowCount int
+	for start, end := 0, 0; end < len(indices); end++ {
+		for indices[end]-indices[start] > lines-1 {
+			start++
+		}
+		if end-start+1 > windowCount {
+			windowStart, windowCount = indices[start], end-start+1
+		}
+	}
+
+	l.first, l.last = math.MaxInt, math.MinInt
+	var residualAcc float64
+	for i, value := range values {
+		if !l.inlier[i] {
+			continue
+		}
+		if l.indices[i] < windowStart || l.indices[i] > windowStart+lines-1 {
+			l.inlier[i] = false
+			continue
+		}
+		l.inliers++
+		l.first = minInt(l.first, l.indices[i])
+		l.last = maxInt(l.last, l.indices[i])
+		residualAcc += math.Abs(value-origin-float64(l.indices[i])*pitch) / pitch
+	}
+	l.residual = residualAcc / float64(l.inliers)
+	return l
+}
+
+// fitLattice1D finds the lattice of at most lines lines most values lie on, RANSAC-like:
+// each hypothesis is drawn from two values and their line index difference, and scored by
+// its inliers (see scoreLattice1D). A lattice of half the pitch only gets more inliers than
+// the actual one if the values span less than half the lines. The best hypothesis is
+// refined by least squares on its inliers, and its sparse border lines trimmed
+func fitLattice1D(values []float64, lines int, rng *rand.Rand) (lattice1D, error) {
+	var best lattice1D
+	if len(values) < LATTICE_FIT_MIN_NODES {
+		return best, fmt.Errorf("%d values, %d required", len(values), LATTICE_FIT_MIN_NODES)
+	}
+	if lines < 2 {
+		return best, fmt.Errorf("at least 2 lines required, %d", lines)
+	}
+	for iteration := 0; iteration < LATTICE_RANSAC_ITERATIONS; iteration++ {
+		i, j := rng.Intn(len(values)), rng.Intn(len(values))
+		delta := math.Abs(values[j] - values[i])
+		if delta < 1 {
+			continue
+		}
+		pitch := delta / float64(1+rng.Intn(lines-1))
+		candidate := scoreLattice1D(values, values[i], pitch, lines)
+		if candidate.inliers > best.inliers || candidate.inliers == best.inliers && candidate.residual < best.residual {
+			best = candidate
+		}
+	}
+	if best.inliers < LATTICE_FIT_MIN_NODES {
+		return best, fmt.Errorf("%d values on a lattice line, %d required", best.inliers, LATTICE_FIT_MIN_NODES)
+	}
+	if best.first == best.last {
+		return best, fmt.Errorf("all %d inliers on a single line", best.inliers)
+	}
+
+	// value = origin + pitch*index, then reindexed
+	for round := 0; round < 2; round++ {
+		var n, indexAcc, valueAcc, indexSquaredAcc, productAcc float64
+		for i, value := range values {
+			if !best.inlier[i] {
+				continue
+			}
+			index := float64(best.indices[i])
+			n++
+			indexAcc += index
+			valueAcc += value
+			indexSquaredAcc += index * index
+			productAcc += index * value
+		}
+		pitch := (n*productAcc - indexAcc*valueAcc) / (n*indexSquaredAcc - indexAcc*indexAcc)
+		origin := (valueAcc - pitch*indexAcc) / n
+		refined := scoreLattice1D(values, origin, pitch, lines)
+		if refined.inliers < best.inliers || refined.first == refined.last {
+			break
+		}
+		best = refined
+	}
+
+	// Border lines much less populated than the others hold extra contours
+	// (e.g. dust) lying on the lattice by chance
+	population := map[int]int{}
+	for i := range values {
+		if best.inlier[i] {
+			population[best.indices[i]]++
+		}
+	}
+	var populations []float64
+	for _, count := range population {
+		populations = append(populations, float64(count))
+	}
+	minPopulation := LATTICE_RANSAC_MIN_LINE_POPULATION * median(populations)
+	for best.first < best.last && float64(population[best.first]) < minPopulation {
+		best.first++
+	}
+	for best.last > best.first && float64(population[best.last]) < minPopulation {
+		best.last--
+	}
+	for i := range values {
+		if best.inlier[i] && (best.indices[i] < best.first || best.indices[i] > best.last) {
+			best.inlier[i] = false
+			best.inliers--
+		}
+	}
+	return best, nil
+}
+
+// inferLattice reconstructs the layout grid from the detected nodes, robust to missing
+// and extra contours: the columns and rows are fitted independently along the pivoted axes
+// (see fitLattice1D), the contours on both indexed as the layout node they lie on and the
+// affine map of the layout onto them fitted. Border lines without contours leave the grid
+// free to slide: it is placed for most contours to lie on a layout node, centered on ties.
+// Returns the grid, indexed as the layout, and the number of contours it was fitted on
+func inferLattice(detectedGridNodes []GridNode, pivotedGridNodes []GridNode, layout *ChipLayout, diagnostics *GridDiagnostics) ([]GridNode, int, error) {
+	rng := rand.New(rand.NewSource(LATTICE_RANSAC_SEED))
+	xs := make([]float64, len(pivotedGridNodes))
+	ys := make([]float64, len(pivotedGridNodes))
+	for i, node := range pivotedGridNodes {
+		xs[i], ys[i] = node.X, node.Y
+	}
+	cols, err := fitLattice1D(xs, layout.Cols, rng)
+	if err != nil {
+		return nil, 0, fmt.Errorf("columns: %w", err)
+	}
+	rows, err := fitLattice1D(ys, layout.Rows, rng)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rows: %w", err)
+	}
+	diagnostics.BordersX = cols.last - cols.first + 1
+	diagnostics.BordersY = rows.last - rows.first + 1
+
+	// Placement of the lines found within the layout
+	colSlack := layout.Cols - diagnostics.BordersX
+	rowSlack := layout.Rows - diagnostics.BordersY
+	var colShift, rowShift int
+	bestCount, bestOffCenter := -1, 0
+	diagnostics.PlacementCandidates = 0
+	for c := 0; c <= colSlack; c++ {
+		for r := 0; r <= rowSlack; r++ {
+			var count int
+			for i := range detectedGridNodes {
+				if cols.inlier[i] && rows.inlier[i] && layout.rowOccupied(rows.indices[i]-rows.first+r, cols.indices[i]-cols.first+c) {
+					count++
+				}
+			}
+			offCenter := absInt(2*c-colSlack) + absInt(2*r-rowSlack)
+			if count > bestCount {
+				diagnostics.PlacementCandidates = 0
+			}
+			if count >= bestCount {
+				diagnostics.PlacementCandidates++
+			}
+			if count > bestCount || count == bestCount && offCenter < bestOffCenter {
+				bestCount, bestOffCenter = count, offCenter
+				colShift, rowShift = c, r
+			}
+		}
+	}
+	if diagnostics.PlacementCandidates > 1 && LOG_LEVEL <= WARNING_LEVEL {
+		WARNINGLogger.Printf("Lattice inference: contours on %d/%d columns and %d/%d rows, %d equally likely placements, the first ones centered at column %d, row %d. The grid may be off by whole columns or rows",
+			diagnostics.BordersX, layout.Cols, diagnostics.BordersY, layout.Rows, diagnostics.PlacementCandidates, colShift, rowShift)
+	}
+
+	// Nearest contour of each layout node
+	nearest := map[[2]int]int{}
+	distance := func(i int) float64 {
+		return math.Hypot(xs[i]-cols.origin-float64(cols.indices[i])*cols.pitch, ys[i]-rows.origin-float64(rows.indices[i])*rows.pitch)
+	}
+	for i := range detectedGridNodes {
+		if !cols.inlier[i] || !rows.inlier[i] {
+			continue
+		}
+		position := [2]int{rows.indices[i] - rows.first + rowShift, cols.indices[i] - cols.first + colShift}
+		if !layout.rowOccupied(position[0], position[1]) {
+			continue
+		}
+		if other, ok := nearest[position]; !ok || distance(i) < distance(other) {
+			nearest[position] = i
+		}
+	}
+	var nodes []GridNode
+	var points [][2]float64
+	for _, layoutNode := range layout.Nodes {
+		if i, ok := nearest[[2]int{layoutNode.Row, layoutNode.Col}]; ok {
+			nodes = append(nodes, layoutNode)
+			points = append(points, [2]float64{detectedGridNodes[i].X, detectedGridNodes[i].Y})
+		}
+	}
+	if len(nodes) < LATTICE_FIT_MIN_NODES {
+		return nil, len(nodes), fmt.Errorf("%d contours on a layout node, %d required", len(nodes), LATTICE_FIT_MIN_NODES)
+	}
+	affine, err := fitAffine(nodes, points)
+	if err != nil {
+		return nil, len(nodes), err
+	}
+
+	grid := make([]GridNode, layout.MMINodes())
+	for n, layoutNode := range layout.Nodes {
+		x, y := affine.Place(layoutNode.Row, layoutNode.Col)
+		grid[n] = GridNode{X: x, Y: y, Row: layoutNode.Row, Col: layoutNode.Col}
+	}
+	return grid, len(nodes), nil
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
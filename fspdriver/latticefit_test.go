@@ -0,0 +1,188 @@
+package fspdriver
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestInferLattice(t *testing.T) {
+	layout, err := LoadChipLayout(CHIP_LAYOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLogLevel(t, ERROR_LEVEL)
+
+	tests := []struct {
+		name string
+		// Whole columns and rows without contours
+		dropCols []int
+		dropRows []int
+		// Placements expected, 1 when the interlacing tells the placement
+		placementCandidates int
+	}{
+		{name: "border columns", dropCols: []int{0, layout.Cols - 1}, placementCandidates: 1},
+		{name: "border rows", dropRows: []int{0, layout.Rows - 1}, placementCandidates: 1},
+		{name: "border column and row", dropCols: []int{0}, dropRows: []int{layout.Rows - 1}, placementCandidates: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			truth := syntheticAffine(1.2)
+			nodes := placeSyntheticGrid(layout, truth, 0.3)
+
+			// Dropped lines, and a tenth of the other nodes
+			rng := rand.New(rand.NewSource(2))
+			dropped := map[int]bool{}
+			for n, layoutNode := range layout.Nodes {
+				dropped[n] = containsInt(test.dropCols, layoutNode.Col) || containsInt(test.dropRows, layoutNode.Row) || rng.Float64() < 0.1
+			}
+			var detected []GridNode
+			var droppedIndices []int
+			for n, node := range nodes {
+				if dropped[n] {
+					droppedIndices = append(droppedIndices, n)
+				} else {
+					detected = append(detected, node)
+				}
+			}
+			// Dust off the lattice, half a pitch away from the nodes
+			for i := 0; i < 12; i++ {
+				row, col := rng.Intn(layout.Rows-1), rng.Intn(layout.Cols-1)
+				x, y := truth.Place(row, col)
+				detected = append(detected, GridNode{
+					X: x + (truth.XCol+truth.XRow)/2,
+					Y: y + (truth.YCol+truth.YRow)/2,
+				})
+			}
+			rng.Shuffle(len(detected), func(i, j int) {
+				detected[i], detected[j] = detected[j], detected[i]
+			})
+
+			options := DefaultDriverOptions().NodeDetection
+			options.LatticeFit = LATTICE_FIT_RANSAC
+			var diagnostics GridDiagnostics
+			spotsGrid, err := computeFullGrid(detected, layout, options, &diagnostics)
+
+			if diagnostics.PlacementCandidates != test.placementCandidates {
+				t.Errorf("PlacementCandidates: %d, expected %d", diagnostics.PlacementCandidates, test.placementCandidates)
+			}
+			if test.placementCandidates > 1 {
+				// Placed at random among the candidates, if at all
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n, node := range spotsGrid.Nodes {
+				x, y := truth.Place(node.Row, node.Col)
+				if distance := math.Hypot(node.X-x, node.Y-y); distance > 1 {
+					t.Errorf("node %d [%d:%d]: %.2f px off", n, node.Row, node.Col, distance)
+				}
+			}
+			inferred := append([]int(nil), diagnostics.InferredNodes...)
+			sort.Ints(inferred)
+			if !equalInts(inferred, droppedIndices) {
+				t.Errorf("InferredNodes: %v, expected the dropped nodes %v", inferred, droppedIndices)
+			}
+		})
+	}
+}
+
+func TestFitLattice(t *testing.T) {
+	layout, err := LoadChipLayout(CHIP_LAYOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLogLevel(t, ERROR_LEVEL)
+
+	// Lattice sheared by 0.8 deg, with unequal column and row pitch
+	sheared := GridAffine{X0: 120, XCol: 37.5, XRow: 0.1, Y0: 60, YCol: 0.3, YRow: 17.4}
+	// Distorted around the grid center, as the fit defines it
+	distorted := sheared
+	for _, layoutNode := range layout.Nodes {
+		x, y := sheared.undistorted(layoutNode.Row, layoutNode.Col)
+		distorted.CenterX += x / float64(len(layout.Nodes))
+		distorted.CenterY += y / float64(len(layout.Nodes))
+	}
+	for _, layoutNode := range layout.Nodes {
+		x, y := sheared.undistorted(layoutNode.Row, layoutNode.Col)
+		distorted.RadialNorm = math.Max(distorted.RadialNorm, math.Hypot(x-distorted.CenterX, y-distorted.CenterY))
+	}
+	distorted.RadialK1 = 0.008
+
+	tests := []struct {
+		name       string
+		latticeFit string
+		truth      GridAffine
+	}{
+		{name: "affine", latticeFit: LATTICE_FIT_AFFINE, truth: sheared},
+		{name: "affine_radial", latticeFit: LATTICE_FIT_AFFINE_RADIAL, truth: distorted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detected := placeSyntheticGrid(layout, test.truth, 0.2)
+
+			options := DefaultDriverOptions().NodeDetection
+			options.LatticeFit = test.latticeFit
+			var diagnostics GridDiagnostics
+			spotsGrid, err := computeFullGrid(detected, layout, options, &diagnostics)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Origin within 0.2 px, pitches within 0.02 px
+			fitted := *diagnostics.Affine
+			for _, term := range []struct {
+				name           string
+				fitted, actual float64
+				maxError       float64
+			}{
+				{"X0", fitted.X0, test.truth.X0, 0.2},
+				{"Y0", fitted.Y0, test.truth.Y0, 0.2},
+				{"XCol", fitted.XCol, test.truth.XCol, 0.02},
+				{"XRow", fitted.XRow, test.truth.XRow, 0.02},
+				{"YCol", fitted.YCol, test.truth.YCol, 0.02},
+				{"YRow", fitted.YRow, test.truth.YRow, 0.02},
+			} {
+				if math.Abs(term.fitted-term.actual) > term.maxError {
+					t.Errorf("%s: %.3f, expected %.3f", term.name, term.fitted, term.actual)
+				}
+			}
+			// k1 compared as the distortion at the truth radial norm
+			if test.truth.RadialK1 != 0 || fitted.RadialK1 != 0 {
+				k1 := fitted.RadialK1 * math.Pow(test.truth.RadialNorm/fitted.RadialNorm, 2)
+				if math.Abs(k1-test.truth.RadialK1) > 0.05*test.truth.RadialK1 {
+					t.Errorf("RadialK1: %.4f (%.4f at the truth norm), expected %.4f", fitted.RadialK1, k1, test.truth.RadialK1)
+				}
+			}
+			// Noise of 0.2 px per axis
+			if diagnostics.FitResidualRMS > 0.4 {
+				t.Errorf("FitResidualRMS: %.2f px", diagnostics.FitResidualRMS)
+			}
+			for n, node := range spotsGrid.Nodes {
+				x, y := test.truth.Place(node.Row, node.Col)
+				if distance := math.Hypot(node.X-x, node.Y-y); distance > 0.5 {
+					t.Errorf("node %d [%d:%d]: %.2f px off", n, node.Row, node.Col, distance)
+				}
+			}
+
+			// The rectangular projection grid misses the shear and the distortion
+			options.LatticeFit = LATTICE_FIT_PROJECTION
+			var projectionDiagnostics GridDiagnostics
+			_, err = computeFullGrid(detected, layout, options, &projectionDiagnostics)
+			if err == nil && projectionDiagnostics.MeanResidual <= 2*diagnostics.MeanResidual {
+				t.Errorf("projection mean residual: %.2f px, %s one: %.2f px", projectionDiagnostics.MeanResidual, test.latticeFit, diagnostics.MeanResidual)
+			}
+		})
+	}
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
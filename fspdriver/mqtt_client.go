@@ -4,7 +4,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -13,18 +12,22 @@ import (
 )
 
 var (
-	MQTT_SCHEME   = "tcp"
-	MQTT_HOST     = "localhost"
-	MQTT_PORT     = "1883"
-	MQTT_USERNAME = ""
-	MQTT_PASSWORD = ""
-
 	DEFAULT_QOS byte = 2
 )
 
+const (
+	// Time given to the in-flight publishes to complete on disconnection
+	MQTT_DISCONNECT_QUIESCE_MS = 1000
+
+	AVAILABILITY_ONLINE  = "online"
+	AVAILABILITY_OFFLINE = "offline"
+)
+
 type MQTTResponse struct {
 	Message interface{}
 	Error   string
+	// CommandId of the command the response is to, if provided
+	CommandId string `json:",omitempty"`
 }
 
 var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
@@ -32,51 +35,13 @@ var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	fmt.Printf("MSG: %s\n", msg.Payload())
 }
 
-func init() {
-	mqttScheme := os.Getenv("MQTT_SCHEME")
-	if mqttScheme != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Printf("Setting MQTT_SCHEME value provided in MQTT_SCHEME env variable : %s", mqttScheme)
-		}
-		MQTT_SCHEME = mqttScheme
-	}
-	mqttHost := os.Getenv("MQTT_HOST")
-	if mqttHost != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Printf("Setting MQTT_HOST value provided in MQTT_HOST env variable : %s", mqttHost)
-		}
-		MQTT_HOST = mqttHost
-	}
-	if MQTT_HOST == "" {
-		ERRORLogger.Fatalf("MQTT_HOST is not defined neither by default nor manually. Exiting.")
-	}
-	mqttPort := os.Getenv("MQTT_PORT")
-	if mqttPort != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Printf("Setting MQTT_PORT value provided in MQTT_PORT env variable : %s", mqttPort)
-		}
-		MQTT_PORT = mqttPort
-	}
-	mqttUsername := os.Getenv("MQTT_USERNAME")
-	if mqttUsername != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Println("Setting MQTT_USERNAME value provided in MQTT_USERNAME env variable : ***")
-		}
-		MQTT_USERNAME = mqttUsername
-	}
-	mqttPassword := os.Getenv("MQTT_PASSWORD")
-	if mqttPassword != "" {
-		if LOG_LEVEL <= INFO_LEVEL {
-			INFOLogger.Println("Setting MQTT_PASSWORD value provided in MQTT_PASSWORD env variable : ***")
-		}
-		MQTT_PASSWORD = mqttPassword
-	}
-}
-
-func NewMQTTClient() (mqtt.Client, error) {
+// NewMQTTClient connects to the broker. The broker publishes
+// an "offline" AvailabilityMessage (retained) on availabilityTopic
+// if the connection is lost without a proper disconnection
+func NewMQTTClient(options MQTTOptions, availabilityTopic string) (mqtt.Client, error) {
 	var err error
 
-	mqttBrokerUri := fmt.Sprintf("%s://%s:%s", MQTT_SCHEME, MQTT_HOST, MQTT_PORT)
+	mqttBrokerUri := fmt.Sprintf("%s://%s:%s", options.Scheme, options.Host, options.Port)
 	// mqttClientID := fmt.Sprintf("seone_%s", SEONE_SN)
 	mqttClientID := uuid.New().String()
 
@@ -88,10 +53,16 @@ func NewMQTTClient() (mqtt.Client, error) {
 		NewClientOptions().
 		AddBroker(mqttBrokerUri).
 		SetClientID(mqttClientID).
-		SetUsername(MQTT_USERNAME).
-		SetPassword(MQTT_PASSWORD)
+		SetUsername(options.Username).
+		SetPassword(options.Password)
 	opts.SetPingTimeout(3 * time.Second)
 
+	will, err := json.Marshal(AvailabilityMessage{Status: AVAILABILITY_OFFLINE})
+	if err != nil {
+		return nil, err
+	}
+	opts.SetBinaryWill(availabilityTopic, will, DEFAULT_QOS, true)
+
 	c := mqtt.NewClient(opts)
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
 		return c, token.Error()
@@ -123,3 +94,15 @@ func PublishJsonMsg(topic string, obj interface{}, mqttClient mqtt.Client) error
 	token.Wait()
 	return token.Error()
 }
+
+// PublishRetainedJsonMsg publishes a message the broker
+// keeps for the clients subscribing later on
+func PublishRetainedJsonMsg(topic string, obj interface{}, mqttClient mqtt.Client) error {
+	msg, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	token := mqttClient.Publish(topic, DEFAULT_QOS, true, msg)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,351 @@
+package fspdriver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Session file layout (little endian):
+//   - RECORDING_MAGIC
+//   - uint32 header length, followed by the JSON encoded RecordingHeader
+//   - frames: int64 unix timestamp (ns), followed by Width*Height luma bytes
+const (
+	RECORDING_MAGIC          = "FSPREC01"
+	RECORDING_FILE_EXTENSION = ".fsprec"
+)
+
+type RecordingHeader struct {
+	Width       int
+	Height      int
+	Framerate   int
+	Calibration CameraCalibrationMessage
+	// Calibration.DarkFrame, left out of the calibration JSON
+	DarkFrame []byte
+}
+
+// CalibratedSource is implemented by the frame sources
+// which carry their own calibration, e.g. recordings.
+// No calibration is performed when acquiring from them
+type CalibratedSource interface {
+	FrameSource
+	Calibration() (CameraCalibrationMessage, error)
+}
+
+// FrameRecorder writes raw luma frames into a session file
+type FrameRecorder struct {
+	path   string
+	f      *os.File
+	w      *bufio.Writer
+	frames int
+}
+
+func NewFrameRecorder(path string, header RecordingHeader) (*FrameRecorder, error) {
+	var err error
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(RECORDING_MAGIC)
+	binary.Write(w, binary.LittleEndian, uint32(len(headerBytes)))
+	_, err = w.Write(headerBytes)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FrameRecorder{path: path, f: f, w: w}, err
+}
+
+func (r *FrameRecorder) WriteFrame(luma []byte, ts time.Time) error {
+	err := binary.Write(r.w, binary.LittleEndian, ts.UnixNano())
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(luma)
+	if err != nil {
+		return err
+	}
+	r.frames++
+	return err
+}
+
+func (r *FrameRecorder) Close() error {
+	err := r.w.Flush()
+	if err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// StartRecording opens a new session file and records the frames
+// acquired by MainLoop from now on. Empty path defaults to
+// a timestamped file in the RecordingsPath option
+func (d *Driver) StartRecording(path string) (string, error) {
+	var err error
+
+	d.recorderMut.Lock()
+	defer d.recorderMut.Unlock()
+
+	if d.recorder != nil {
+		return d.recorder.path, fmt.Errorf("recording is already in progress: %s", d.recorder.path)
+	}
+	if path == "" {
+		err = os.MkdirAll(d.options.RecordingsPath, os.ModePerm)
+		if err != nil {
+			return path, err
+		}
+		path = filepath.Join(d.options.RecordingsPath, fmt.Sprintf("%d%s", time.Now().UnixMilli(), RECORDING_FILE_EXTENSION))
+	}
+	calibration := d.getCalibration()
+	header := RecordingHeader{
+		Width:       d.options.FrameWidth,
+		Height:      d.options.FrameHeight,
+		Framerate:   d.getFramerate(),
+		Calibration: calibration,
+		DarkFrame:   calibration.DarkFrame,
+	}
+	recorder, err := NewFrameRecorder(path, header)
+	if err != nil {
+		return path, err
+	}
+	d.recorder = recorder
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Started recording: %s", path)
+	}
+	return path, err
+}
+
+// StopRecording closes the current session file, if any
+func (d *Driver) StopRecording() (RecordingMessage, error) {
+	var err error
+
+	d.recorderMut.Lock()
+	defer d.recorderMut.Unlock()
+
+	if d.recorder == nil {
+		return RecordingMessage{}, err
+	}
+	msg := RecordingMessage{
+		Path:   d.recorder.path,
+		Frames: d.recorder.frames,
+	}
+	err = d.recorder.Close()
+	d.recorder = nil
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Stopped recording: %s. Frames: %d", msg.Path, msg.Frames)
+	}
+	return msg, err
+}
+
+func (d *Driver) getRecordingMessage() RecordingMessage {
+	d.recorderMut.Lock()
+	defer d.recorderMut.Unlock()
+
+	if d.recorder == nil {
+		return RecordingMessage{}
+	}
+	return RecordingMessage{
+		Recording: true,
+		Path:      d.recorder.path,
+		Frames:    d.recorder.frames,
+	}
+}
+
+// recordFrame writes the luma plane to the current session file, if any.
+// A failing recording is stopped
+func (d *Driver) recordFrame(luma []byte, ts time.Time) {
+	d.recorderMut.Lock()
+	defer d.recorderMut.Unlock()
+
+	if d.recorder == nil {
+		return
+	}
+	err := d.recorder.WriteFrame(luma, ts)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while recording frame, stopping the recording: %s", err.Error())
+		}
+		d.recorder.Close()
+		d.recorder = nil
+	}
+}
+
+// ReplayFrameSource reads the frames back from a session file,
+// pacing them as recorded (scaled by speed)
+type ReplayFrameSource struct {
+	path  string
+	speed float64
+
+	f        *os.File
+	r        *bufio.Reader
+	header   RecordingHeader
+	openTs   time.Time
+	firstTs  time.Time
+	hasFirst bool
+	buf      []byte
+}
+
+func NewReplayFrameSource(path string, speed float64) *ReplayFrameSource {
+	return &ReplayFrameSource{
+		path:  path,
+		speed: speed,
+	}
+}
+
+func readRecordingHeader(r io.Reader) (RecordingHeader, error) {
+	var header RecordingHeader
+
+	magic := make([]byte, len(RECORDING_MAGIC))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return header, err
+	}
+	if string(magic) != RECORDING_MAGIC {
+		return header, fmt.Errorf("not a recording session file")
+	}
+	var headerLength uint32
+	err = binary.Read(r, binary.LittleEndian, &headerLength)
+	if err != nil {
+		return header, err
+	}
+	headerBytes := make([]byte, headerLength)
+	_, err = io.ReadFull(r, headerBytes)
+	if err != nil {
+		return header, err
+	}
+	err = json.Unmarshal(headerBytes, &header)
+	return header, err
+}
+
+func (s *ReplayFrameSource) Calibration() (CameraCalibrationMessage, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return CameraCalibrationMessage{}, err
+	}
+	defer f.Close()
+	header, err := readRecordingHeader(bufio.NewReader(f))
+	header.Calibration.DarkFrame = header.DarkFrame
+	return header.Calibration, err
+}
+
+func (s *ReplayFrameSource) Open(settings CameraSettings) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	header, err := readRecordingHeader(r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if header.Width != settings.Width || header.Height != settings.Height {
+		f.Close()
+		return fmt.Errorf("recording frame size %dx%d does not match %dx%d", header.Width, header.Height, settings.Width, settings.Height)
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Replaying %s (recorded at %d FPS) at speed %.2f", s.path, header.Framerate, s.speed)
+	}
+	w := header.Width
+	h := header.Height
+	s.buf = make([]byte, w*h+w*h/2)
+	// Chroma plane is not recorded
+	for i := w * h; i < len(s.buf); i++ {
+		s.buf[i] = 128
+	}
+	s.f = f
+	s.r = r
+	s.header = header
+	s.openTs = time.Now()
+	s.hasFirst = false
+	return err
+}
+
+func (s *ReplayFrameSource) NextFrame() ([]byte, time.Time, error) {
+	var tsNano int64
+	err := binary.Read(s.r, binary.LittleEndian, &tsNano)
+	if err == io.EOF {
+		return s.buf, time.Time{}, ErrEndOfStream
+	}
+	if err != nil {
+		return s.buf, time.Time{}, err
+	}
+	_, err = io.ReadFull(s.r, s.buf[:s.header.Width*s.header.Height])
+	if err != nil {
+		return s.buf, time.Time{}, err
+	}
+	ts := time.Unix(0, tsNano)
+	if !s.hasFirst {
+		s.firstTs = ts
+		s.hasFirst = true
+	}
+	if s.speed > 0 {
+		elapsed := float64(ts.Sub(s.firstTs)) / s.speed
+		time.Sleep(time.Until(s.openTs.Add(time.Duration(elapsed))))
+	}
+	return s.buf, ts, err
+}
+
+func (s *ReplayFrameSource) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (d *Driver) GetRecordingHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_GET_RECORDING_CB_MQTT_TOPIC_PATH)
+
+	respObj := MQTTResponse{
+		Message: d.getRecordingMessage(),
+	}
+	err = PublishJsonMsg(respTopic, respObj, client)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in GetRecordingHandler MQTT CB: %s", err.Error())
+		}
+	}
+}
+
+func (d *Driver) SetRecordingHandler(client mqtt.Client, msg mqtt.Message) {
+	var err error
+	respTopic := d.getFullTopicString(CAMERA_SET_RECORDING_CB_MQTT_TOPIC_PATH)
+
+	payload := msg.Payload()
+	var recording RecordingMessage
+	err = json.Unmarshal(payload, &recording)
+	if err != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred in SetRecordingHandler MQTT CB while unmarshalling the JSON message: %s", err.Error())
+		}
+	}
+	d.submitCommand(command{
+		name:      fmt.Sprintf("SET_RECORDING=%t", recording.Recording),
+		id:        parseCommandId(payload),
+		respTopic: respTopic,
+		run: func() (interface{}, error) {
+			if err != nil {
+				return d.getRecordingMessage(), err
+			}
+			return d.commandRecording(recording)
+		},
+	})
+}
@@ -0,0 +1,362 @@
+package fspdriver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PHASE_TRAJECTORY_CONSTANT = "constant"
+	PHASE_TRAJECTORY_STEP     = "step"
+	PHASE_TRAJECTORY_RAMP     = "ramp"
+	PHASE_TRAJECTORY_SINE     = "sine"
+)
+
+// PhaseTrajectory describes the phase (rad) of a simulated MZI
+// as a function of the time elapsed since the simulator was opened:
+//   - constant: Offset
+//   - step: Offset, then Offset+Amplitude after Delay seconds
+//   - ramp: Offset, then increasing by Rate rad/s after Delay seconds
+//   - sine: Offset + Amplitude*sin(2*pi*(t-Delay)/Period)
+type PhaseTrajectory struct {
+	Type      string  `yaml:"type"`
+	Offset    float64 `yaml:"offset"`
+	Amplitude float64 `yaml:"amplitude"`
+	Rate      float64 `yaml:"rate"`
+	Period    float64 `yaml:"period"`
+	Delay     float64 `yaml:"delay"`
+}
+
+func (t PhaseTrajectory) PhaseAt(elapsed float64) float64 {
+	switch t.Type {
+	case PHASE_TRAJECTORY_STEP:
+		if elapsed < t.Delay {
+			return t.Offset
+		}
+		return t.Offset + t.Amplitude
+	case PHASE_TRAJECTORY_RAMP:
+		if elapsed < t.Delay {
+			return t.Offset
+		}
+		return t.Offset + t.Rate*(elapsed-t.Delay)
+	case PHASE_TRAJECTORY_SINE:
+		if t.Period <= 0 {
+			return t.Offset
+		}
+		return t.Offset + t.Amplitude*math.Sin(2*math.Pi*(elapsed-t.Delay)/t.Period)
+	default:
+		return t.Offset
+	}
+}
+
+// SimulatorConfig describes the synthetic chip image.
+// Spot intensities scale linearly with the shutter speed and the gain,
+// being SpotAmplitude*(1 +/- SpotVisibility) at ReferenceShutterSpeed
+type SimulatorConfig struct {
+	GridCenterX  float64 `yaml:"grid_center_x"`
+	GridCenterY  float64 `yaml:"grid_center_y"`
+	GridPitchX   float64 `yaml:"grid_pitch_x"` // Distance between two columns, px
+	GridPitchY   float64 `yaml:"grid_pitch_y"` // Distance between two (interlaced) rows, px
+	GridAngleDeg float64 `yaml:"grid_angle_deg"`
+
+	SpotSigma      float64 `yaml:"spot_sigma"` // Gaussian spot standard deviation, px
+	SpotAmplitude  float64 `yaml:"spot_amplitude"`
+	SpotVisibility float64 `yaml:"spot_visibility"`
+
+	ReferenceShutterSpeed int     `yaml:"reference_shutter_speed"`
+	DarkLevel             float64 `yaml:"dark_level"`
+	NoiseStd              float64 `yaml:"noise_std"`
+	Seed                  int64   `yaml:"seed"`
+
+	DefaultTrajectory PhaseTrajectory `yaml:"default_trajectory"`
+	// Per-MZI trajectories, indexed as the chip layout MZIs.
+	// MZIs not listed follow the DefaultTrajectory
+	Trajectories map[int]PhaseTrajectory `yaml:"trajectories"`
+}
+
+func DefaultSimulatorConfig() SimulatorConfig {
+	return SimulatorConfig{
+		GridCenterX:  CAMERA_FRAME_WIDTH / 2,
+		GridCenterY:  CAMERA_FRAME_HEIGHT / 2,
+		GridPitchX:   32,
+		GridPitchY:   16,
+		GridAngleDeg: 1,
+
+		SpotSigma:      2,
+		SpotAmplitude:  100,
+		SpotVisibility: 0.5,
+
+		ReferenceShutterSpeed: 1000,
+		DarkLevel:             16,
+		NoiseStd:              2,
+		Seed:                  1,
+
+		DefaultTrajectory: PhaseTrajectory{
+			Type:      PHASE_TRAJECTORY_SINE,
+			Amplitude: math.Pi,
+			Period:    60,
+		},
+		Trajectories: map[int]PhaseTrajectory{},
+	}
+}
+
+// LoadSimulatorConfig reads a YAML (or JSON) simulator config, with the keys
+// of the simulator section of the config file.
+// Fields missing from the file keep their default values, unknown keys are rejected
+func LoadSimulatorConfig(path string) (SimulatorConfig, error) {
+	config := DefaultSimulatorConfig()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	content, err = retagTrajectoryIndices(content)
+	if err != nil {
+		return config, fmt.Errorf("simulator config %s: %w", path, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err == io.EOF {
+		// Empty file
+		return config, config.Validate()
+	}
+	if err != nil {
+		return config, fmt.Errorf("simulator config %s: %w", path, err)
+	}
+	return config, config.Validate()
+}
+
+// retagTrajectoryIndices retags the keys of the trajectories as integers,
+// JSON object keys being strings
+func retagTrajectoryIndices(content []byte) ([]byte, error) {
+	var root yaml.Node
+	err := yaml.Unmarshal(content, &root)
+	if err != nil || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return content, err
+	}
+	retagged := false
+	mapping := root.Content[0].Content
+	for i := 0; i+1 < len(mapping); i += 2 {
+		if mapping[i].Value != "trajectories" || mapping[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		trajectories := mapping[i+1].Content
+		for j := 0; j < len(trajectories); j += 2 {
+			if trajectories[j].Tag == "!!str" {
+				trajectories[j].Tag = "!!int"
+				trajectories[j].Style = 0
+				retagged = true
+			}
+		}
+	}
+	if !retagged {
+		return content, err
+	}
+	return yaml.Marshal(&root)
+}
+
+func (c SimulatorConfig) Validate() error {
+	for mziIdx := range c.Trajectories {
+		if mziIdx < 0 {
+			return fmt.Errorf("simulator config: invalid MZI index in Trajectories: %d", mziIdx)
+		}
+	}
+	if c.SpotSigma <= 0 {
+		return fmt.Errorf("simulator config: SpotSigma must be positive: %g", c.SpotSigma)
+	}
+	return nil
+}
+
+// SpotCenters returns the subpixel centers of the simulated MMI spots
+// of the chip layout, indexed the same way as the calibrated grid
+func (c SimulatorConfig) SpotCenters(layout *ChipLayout) [][2]float64 {
+	centers := make([][2]float64, layout.MMINodes())
+
+	angleRad := deg2Rad(c.GridAngleDeg)
+	for n, node := range layout.Nodes {
+		dx := (float64(node.Col) - float64(layout.Cols-1)/2) * c.GridPitchX
+		dy := (float64(node.Row) - float64(layout.Rows-1)/2) * c.GridPitchY
+
+		centers[n][0] = c.GridCenterX + dx*math.Cos(angleRad) - dy*math.Sin(angleRad)
+		centers[n][1] = c.GridCenterY + dx*math.Sin(angleRad) + dy*math.Cos(angleRad)
+	}
+	return centers
+}
+
+// MZIPhasesAt returns the injected phases of the nMZIs MZIs
+// at elapsed seconds since the simulator was opened
+func (c SimulatorConfig) MZIPhasesAt(elapsed float64, nMZIs int) []float64 {
+	phases := make([]float64, nMZIs)
+	for i := range phases {
+		trajectory, ok := c.Trajectories[i]
+		if !ok {
+			trajectory = c.DefaultTrajectory
+		}
+		phases[i] = trajectory.PhaseAt(elapsed)
+	}
+	return phases
+}
+
+// GroundTruthSource is implemented by the frame sources
+// which know the MZI phases they produce
+type GroundTruthSource interface {
+	MZIPhases(ts time.Time) []float64
+}
+
+// SimulatorFrameSource renders synthetic NV12 frames of the chip.
+// Each MZI drives the intensities of its a/b/c MMIs 120 degrees apart,
+// so that ExtractMZIsIndexed recovers the injected phase
+type SimulatorFrameSource struct {
+	config     SimulatorConfig
+	chipLayout string
+	layout     *ChipLayout
+
+	settings CameraSettings
+	rng      *rand.Rand
+	centers  [][2]float64
+	openTs   time.Time
+	i        int
+	stopChan chan bool
+
+	acc []float64
+	buf []byte
+}
+
+// NewSimulatorFrameSource renders the chip of the layout
+// of the given name or path, see LoadChipLayout
+func NewSimulatorFrameSource(config SimulatorConfig, chipLayout string) *SimulatorFrameSource {
+	return &SimulatorFrameSource{
+		config:     config,
+		chipLayout: chipLayout,
+	}
+}
+
+func (s *SimulatorFrameSource) Open(settings CameraSettings) error {
+	var err error
+	if settings.Framerate <= 0 {
+		return fmt.Errorf("simulator: invalid framerate: %d", settings.Framerate)
+	}
+	s.layout, err = LoadChipLayout(s.chipLayout)
+	if err != nil {
+		return err
+	}
+	for mziIdx := range s.config.Trajectories {
+		if mziIdx >= s.layout.MZINodes() {
+			return fmt.Errorf("simulator: invalid MZI index in Trajectories: %d", mziIdx)
+		}
+	}
+	s.settings = settings
+	s.rng = rand.New(rand.NewSource(s.config.Seed))
+	s.centers = s.config.SpotCenters(s.layout)
+	s.openTs = time.Now()
+	s.i = 0
+	s.stopChan = make(chan bool)
+
+	w := settings.Width
+	h := settings.Height
+	s.acc = make([]float64, w*h)
+	s.buf = make([]byte, w*h+w*h/2)
+	// Chroma plane is neutral
+	for i := w * h; i < len(s.buf); i++ {
+		s.buf[i] = 128
+	}
+	return err
+}
+
+func (s *SimulatorFrameSource) NextFrame() ([]byte, time.Time, error) {
+	var err error
+	framePeriod := time.Second / time.Duration(s.settings.Framerate)
+	ts := s.openTs.Add(time.Duration(s.i) * framePeriod)
+	s.i++
+
+	// Pace the frames as a real camera would
+	select {
+	case <-s.stopChan:
+		return s.buf, ts, fmt.Errorf("simulator: source is closed")
+	case <-time.After(time.Until(ts)):
+	}
+
+	s.render(ts.Sub(s.openTs).Seconds())
+	return s.buf, ts, err
+}
+
+// SetExposure applies from the next frame on
+func (s *SimulatorFrameSource) SetExposure(shutterSpeed int, gain float64) error {
+	s.settings.ShutterSpeed = shutterSpeed
+	s.settings.Gain = gain
+	return nil
+}
+
+func (s *SimulatorFrameSource) Close() error {
+	if s.stopChan == nil {
+		return nil
+	}
+	select {
+	case <-s.stopChan: // Already closed
+	default:
+		close(s.stopChan)
+	}
+	return nil
+}
+
+func (s *SimulatorFrameSource) MZIPhases(ts time.Time) []float64 {
+	return s.config.MZIPhasesAt(ts.Sub(s.openTs).Seconds(), s.layout.MZINodes())
+}
+
+func (s *SimulatorFrameSource) render(elapsed float64) {
+	w := s.settings.Width
+	h := s.settings.Height
+	c := s.config
+
+	for i := range s.acc {
+		s.acc[i] = c.DarkLevel
+	}
+
+	gain := s.settings.Gain
+	if c.ReferenceShutterSpeed > 0 {
+		gain *= float64(s.settings.ShutterSpeed) / float64(c.ReferenceShutterSpeed)
+	}
+	mean := c.SpotAmplitude * gain
+	modulation := mean * c.SpotVisibility
+
+	intensities := make([]float64, s.layout.MMINodes())
+	for i, phase := range c.MZIPhasesAt(elapsed, s.layout.MZINodes()) {
+		mmiIndices := s.layout.MZIMMIIndices[i]
+		intensities[mmiIndices[2]] = mean + modulation*math.Cos(phase+2*math.Pi/3)
+		intensities[mmiIndices[1]] = mean + modulation*math.Cos(phase)
+		intensities[mmiIndices[0]] = mean + modulation*math.Cos(phase-2*math.Pi/3)
+	}
+
+	radius := int(math.Ceil(4 * c.SpotSigma))
+	for n, center := range s.centers {
+		cx := int(math.Round(center[0]))
+		cy := int(math.Round(center[1]))
+		for y := cy - radius; y <= cy+radius; y++ {
+			if y < 0 || y >= h {
+				continue
+			}
+			for x := cx - radius; x <= cx+radius; x++ {
+				if x < 0 || x >= w {
+					continue
+				}
+				dx := float64(x) - center[0]
+				dy := float64(y) - center[1]
+				s.acc[y*w+x] += intensities[n] * math.Exp(-(dx*dx+dy*dy)/(2*c.SpotSigma*c.SpotSigma))
+			}
+		}
+	}
+
+	for i, v := range s.acc {
+		if c.NoiseStd > 0 {
+			v += c.NoiseStd * s.rng.NormFloat64()
+		}
+		s.buf[i] = byte(math.Max(0, math.Min(255, math.Round(v))))
+	}
+}
@@ -1,18 +1,18 @@
 package fspdriver
 
 import (
-	"encoding/csv"
 	"fmt"
 	"image"
 	"image/color"
 	"math"
-	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
 	"gocv.io/x/gocv"
 )
 
+// Defaults of NodeDetectionOptions
 const (
 
 	// Discard contours which area is
@@ -32,22 +32,24 @@ const (
 	// 100 is a little bit more than half (192 MMIs in total)
 	NODE_DETECTION_MINIMUM_PRIMARY_CONTOURS = 100
 
-	NODE_DETECTION_COMMON_ANGLE_SEARCH_ARC_DEG  = 5
-	NODE_DETECTION_COMMON_ANGLE_SEARCH_STEP_DEG = 0.1
+	// Common angle search: arc swept on both sides of the axes, by the
+	// coarse step, refined down to the precision, see findCommonAngleRad.
+	// Bins the projections are divided into to compute an angle energy
+	NODE_DETECTION_COMMON_ANGLE_SEARCH_ARC_DEG       = 5
+	NODE_DETECTION_COMMON_ANGLE_SEARCH_STEP_DEG      = 0.25
+	NODE_DETECTION_COMMON_ANGLE_SEARCH_PRECISION_DEG = 0.005
+	NODE_DETECTION_COMMON_ANGLE_SEARCH_BINS          = 90
+	// Step division between two refinement sweeps
+	NODE_DETECTION_COMMON_ANGLE_REFINEMENT = 5
+
+	// Lattice validation: max deviation from perpendicularity of the
+	// horizontal and vertical angles, max distance (px) of a node to its
+	// nearest contour for it to be matched, and min share of matched nodes
+	NODE_DETECTION_MAX_ANGLE_DISAGREEMENT_DEG = 1
+	NODE_DETECTION_MAX_NODE_RESIDUAL          = 4
+	NODE_DETECTION_MIN_MATCHED_FRACTION       = 0.5
 )
 
-var (
-	NODE_DETECTION_EFFECTIVE_GRID [MMI_N_NODES]GridNode
-)
-
-var (
-	NODE_DETECTION_IMAGES_PATH = "images"
-)
-
-func InitImagesPath() {
-	os.MkdirAll(NODE_DETECTION_IMAGES_PATH, os.ModePerm)
-}
-
 func computeBorders(a []float64) []float64 {
 	// log.Println("Computing borders. Initial elements:", len(a))
 
@@ -93,56 +95,88 @@ func computeBorders(a []float64) []float64 {
 	return bordersA
 }
 
-// findCommonAngleRad will linearly search
-// for the angle
-// at which the grid is pivoted on the image
-// TODO: implement bilateral minimum search instead of linear sweep
+// angleEnergy projects the nodes on the theta direction and sums the 4th power of the
+// populations of the bins the projections range is divided into. Bins are a third of
+// a bin apart (semi-sliding bins), so a bin population is that of 3 consecutive thirds
+func angleEnergy(theta float64, gridNodes []GridNode, bins int) float64 {
+	var min float64 = math.MaxFloat64  // init min variable as a very high one
+	var max float64 = -math.MaxFloat64 // init max variable as a very low one
+	cos, sin := math.Cos(theta), math.Sin(theta)
+	rs := make([]float64, len(gridNodes))
+	for i, gridNode := range gridNodes {
+		// Calculate r as a function of theta
+		r := gridNode.X*cos + gridNode.Y*sin
+		min = math.Min(min, r)
+		max = math.Max(max, r)
+		rs[i] = r
+	}
+	third := (max - min) / float64(3*bins)
+	if third == 0 {
+		return math.Pow(float64(len(rs)), 4)
+	}
+	// The last r may round up to the 3*bins th third
+	thirds := make([]float64, 3*bins+3)
+	for _, r := range rs {
+		thirds[int((r-min)/third)]++
+	}
+	var energy float64
+	for bin := 0; bin < 3*bins; bin++ {
+		population := thirds[bin] + thirds[bin+1] + thirds[bin+2]
+		energy += population * population * population * population
+	}
+	return energy
+}
+
+// findCommonAngleRad searches for the angle at which the grid is pivoted on the image,
+// i.e. that of maximal angleEnergy, coarse to fine: the arc around aroundAngleRad is
+// swept by angleStepRad, then the step around the best angle by a step
+// NODE_DETECTION_COMMON_ANGLE_REFINEMENT times finer, and so on down to precisionRad.
+// The energy being flat at the scale of the finest steps, the angle is taken
+// at the middle of the best run of equal energies. Returns the angle and the
+// number of energy evaluations
 func findCommonAngleRad(
 	aroundAngleRad float64,
 	angleToSweepRad float64,
 	angleStepRad float64,
+	precisionRad float64,
+	bins int,
 	gridNodes []GridNode,
-) float64 {
-	var commonAngle float64
-	var angleStepsInt int = int(math.Round(angleToSweepRad / angleStepRad))
-	// These are what we search for
-	var commonAngleEnergy float64 = 0
-	for angleIdx := -angleStepsInt; angleIdx < angleStepsInt; angleIdx++ {
-		var min float64 = math.MaxFloat64  // init min variable as a very high one
-		var max float64 = -math.MaxFloat64 // init max variable as a very low one
-		// Define the theta
-		theta := aroundAngleRad + float64(angleIdx)*angleStepRad
-		var rs []float64
-		for _, gridNode := range gridNodes {
-			// Calculate r as a function of just defined theta
-			r := float64(gridNode.X)*math.Cos(theta) + float64(gridNode.Y)*math.Sin(theta)
-			// Use the loop to get the range of r values
-			min = math.Min(min, r)
-			max = math.Max(max, r)
-			rs = append(rs, r)
-		}
-		step := (max - min) / 90 // divide into 90 bins // TODO: Optimize this hard-coded params
-		binWidth := step / 3     // Bins overlap 1/3 one upon another (semi-sliding bin)
-		var binEnergySum float64 = 0
-		// Calculte the enery of each bin
-		for bin := min; bin < max; bin += binWidth {
-			var binPopulation float64 = 0
-			for _, r := range rs {
-				if bin <= r && r < bin+step {
-					binPopulation++
-				}
+) (float64, int) {
+	var commonAngle = aroundAngleRad
+	var evaluations int
+	arc := angleToSweepRad
+	step := angleStepRad
+	for {
+		center := commonAngle
+		angleStepsInt := int(math.Round(arc / step))
+		// Best run of equal energies
+		var bestEnergy float64 = -1
+		var runStart, runEnd float64
+		var inRun bool
+		for angleIdx := -angleStepsInt; angleIdx <= angleStepsInt; angleIdx++ {
+			theta := center + float64(angleIdx)*step
+			energy := angleEnergy(theta, gridNodes, bins)
+			evaluations++
+			switch {
+			case energy > bestEnergy:
+				bestEnergy = energy
+				runStart, runEnd = theta, theta
+				inRun = true
+			case energy == bestEnergy && inRun:
+				runEnd = theta
+			default:
+				inRun = false
 			}
-			binEnergySum += math.Pow(binPopulation, 4)
 		}
-		// log.Printf("Bin energy sum for angleNb %d: %.2f", angleNb, binEnergySum)
-		// Save the value of commonAngle if its energy is higher than previously captured one
-		if binEnergySum > commonAngleEnergy {
-			commonAngle = theta
-			commonAngleEnergy = binEnergySum
+		commonAngle = (runStart + runEnd) / 2
+
+		if step <= precisionRad {
+			break
 		}
+		arc = step
+		step = math.Max(step/NODE_DETECTION_COMMON_ANGLE_REFINEMENT, precisionRad)
 	}
-
-	return commonAngle
+	return commonAngle, evaluations
 }
 
 func rad2Deg(rad float64) float64 {
@@ -153,14 +187,14 @@ func deg2Rad(deg float64) float64 {
 	return (math.Pi / 180) * deg
 }
 
-func pivot(x int, y int, pivotPointX int, pivotPointY int, angleRad float64) (int, int) {
+func pivot(x float64, y float64, pivotPointX float64, pivotPointY float64, angleRad float64) (float64, float64) {
 	// Subtract the pivot point
 	centeredX := pivotPointX - x
 	centeredY := pivotPointY - y
 
 	// Rotate
-	pivotedCenteredX := int(float64(centeredX)*math.Cos(angleRad) - float64(centeredY)*math.Sin(angleRad))
-	pivotedCenteredY := int(float64(centeredX)*math.Sin(angleRad) + float64(centeredY)*math.Cos(angleRad))
+	pivotedCenteredX := centeredX*math.Cos(angleRad) - centeredY*math.Sin(angleRad)
+	pivotedCenteredY := centeredX*math.Sin(angleRad) + centeredY*math.Cos(angleRad)
 
 	// Add up the pivot point back
 	pivotedX := pivotPointX - pivotedCenteredX
@@ -169,37 +203,42 @@ func pivot(x int, y int, pivotPointX int, pivotPointY int, angleRad float64) (in
 	return pivotedX, pivotedY
 }
 
-func DrawSpotsgridDebug(mat gocv.Mat, grid [MMI_N_NODES]GridNode) {
+// Fractional bits of the sub-pixel drawing coordinates
+const DRAWING_SHIFT = 4
+
+// subPixelPt returns the point to draw at x, y with DRAWING_SHIFT
+func subPixelPt(x, y float64) image.Point {
+	return image.Pt(int(math.Round(x*(1<<DRAWING_SHIFT))), int(math.Round(y*(1<<DRAWING_SHIFT))))
+}
+
+// pixelPt returns the pixel of x, y, e.g. to put text at
+func pixelPt(x, y float64) image.Point {
+	return image.Pt(int(math.Round(x)), int(math.Round(y)))
+}
+
+func DrawSpotsgridDebug(mat gocv.Mat, grid []GridNode, layout *ChipLayout, radius int) {
 
 	for nodeI, node := range grid {
-		gocv.Ellipse(
+		gocv.EllipseWithParams(
 			&mat,
-			image.Pt(node.X, node.Y),
-			image.Pt(MMI_EXTRACTION_ELLIPSE_RADIUS, MMI_EXTRACTION_ELLIPSE_RADIUS),
+			subPixelPt(node.X, node.Y),
+			image.Pt(radius<<DRAWING_SHIFT, radius<<DRAWING_SHIFT),
 			0, 0, 360,
 			color.RGBA{R: 255, G: 0, B: 255, A: 255},
 			1,
+			gocv.LineAA,
+			DRAWING_SHIFT,
 		)
-		var mziIdx int
-		var mmiL int
-	LoopMZI:
-		for i, mzi := range MZI_MMI_GRID_MAP {
-			for l, mmi := range mzi {
-				if node.Row == mmi[0] && node.Col == mmi[1] {
-					mziIdx = i
-					mmiL = l
-					break LoopMZI
-				}
-			}
+		mziIdx, mmiLetter, ok := layout.MZIOf(nodeI)
+		mziStr := "-"
+		if ok {
+			mziStr = fmt.Sprintf("[%s]%d%c", layout.MZIs[mziIdx].Label, mziIdx, mmiLetter)
 		}
-		mziRow := mziIdx / 4
-		mziCol := mziIdx % 4
-		mziRowStr := string("PONMLKJIHGFEDCBA"[mziRow])
 
 		gocv.PutText(
 			&mat,
 			fmt.Sprintf("%d[%d:%d]", nodeI, node.Row, node.Col),
-			image.Pt(node.X+2, node.Y-4),
+			pixelPt(node.X+2, node.Y-4),
 			gocv.FontHersheyPlain,
 			0.7,
 			color.RGBA{R: 255, G: 255, B: 0, A: 255},
@@ -207,8 +246,8 @@ func DrawSpotsgridDebug(mat gocv.Mat, grid [MMI_N_NODES]GridNode) {
 		)
 		gocv.PutText(
 			&mat,
-			fmt.Sprintf("[%s%d]%d%s", mziRowStr, mziCol, mziIdx, [3]string{"a", "b", "c"}[mmiL]),
-			image.Pt(node.X+2, node.Y+4),
+			mziStr,
+			pixelPt(node.X+2, node.Y+4),
 			gocv.FontHersheyPlain,
 			0.7,
 			color.RGBA{R: 255, G: 255, B: 0, A: 255},
@@ -217,28 +256,55 @@ func DrawSpotsgridDebug(mat gocv.Mat, grid [MMI_N_NODES]GridNode) {
 	}
 }
 
-func computeFullGrid(detectedGridNodes []GridNode) ([MMI_N_NODES]GridNode, error) {
+// computeFullGrid fits the chip layout lattice on the detected nodes.
+// The diagnostics are filled as far as the fit went
+func computeFullGrid(detectedGridNodes []GridNode, layout *ChipLayout, options NodeDetectionOptions, diagnostics *GridDiagnostics) (SpotsGridMessage, error) {
 	var err error
-	var grid [MMI_N_NODES]GridNode
+	spotsGrid := SpotsGridMessage{
+		ChipLayout: layout.Name,
+	}
+	diagnostics.DetectedNodes = len(detectedGridNodes)
+	diagnostics.ExpectedNodes = layout.MMINodes()
+	diagnostics.ExpectedBordersX = layout.Cols
+	diagnostics.ExpectedBordersY = layout.Rows
 
-	HorizontalAngleRad := findCommonAngleRad(
+	angleSearchStart := time.Now()
+	HorizontalAngleRad, horizontalEvaluations := findCommonAngleRad(
 		0, // 0 for horizontal axis
-		deg2Rad(NODE_DETECTION_COMMON_ANGLE_SEARCH_ARC_DEG),
-		deg2Rad(NODE_DETECTION_COMMON_ANGLE_SEARCH_STEP_DEG),
+		deg2Rad(options.CommonAngleSearchArcDeg),
+		deg2Rad(options.CommonAngleSearchStepDeg),
+		deg2Rad(options.CommonAngleSearchPrecisionDeg),
+		options.CommonAngleSearchBins,
 		detectedGridNodes,
 	)
-	VerticalAngleRad := findCommonAngleRad(
+	VerticalAngleRad, verticalEvaluations := findCommonAngleRad(
 		math.Pi/2, // 90 for vertical axis
-		deg2Rad(NODE_DETECTION_COMMON_ANGLE_SEARCH_ARC_DEG),
-		deg2Rad(NODE_DETECTION_COMMON_ANGLE_SEARCH_STEP_DEG),
+		deg2Rad(options.CommonAngleSearchArcDeg),
+		deg2Rad(options.CommonAngleSearchStepDeg),
+		deg2Rad(options.CommonAngleSearchPrecisionDeg),
+		options.CommonAngleSearchBins,
 		detectedGridNodes,
 	)
+	diagnostics.AngleSearchMs = float64(time.Since(angleSearchStart).Microseconds()) / 1000
+	if LOG_LEVEL <= DEBUG_LEVEL {
+		DEBUGLogger.Printf("Common angle search: %d angles evaluated in %.1f ms", horizontalEvaluations+verticalEvaluations, diagnostics.AngleSearchMs)
+	}
 
 	forwardEffectiveAngleRad := (HorizontalAngleRad + VerticalAngleRad - math.Pi/2) / 2
 	backwardEffectiveAngleRad := -forwardEffectiveAngleRad
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Printf("Grid's horizontal angle: %.2f; Grid's vertical angle: %.2f. Effective Angle: %.2f", rad2Deg(HorizontalAngleRad), rad2Deg(VerticalAngleRad), rad2Deg(forwardEffectiveAngleRad))
 	}
+	diagnostics.HorizontalAngleDeg = rad2Deg(HorizontalAngleRad)
+	diagnostics.VerticalAngleDeg = rad2Deg(VerticalAngleRad)
+	diagnostics.AngleDeg = rad2Deg(forwardEffectiveAngleRad)
+
+	angleDisagreementDeg := math.Abs(diagnostics.VerticalAngleDeg - 90 - diagnostics.HorizontalAngleDeg)
+	if angleDisagreementDeg > options.MaxAngleDisagreementDeg {
+		err = fmt.Errorf("horizontal (%.2f deg) and vertical (%.2f deg) grid angles are %.2f deg off perpendicular, beyond %.2f deg",
+			diagnostics.HorizontalAngleDeg, diagnostics.VerticalAngleDeg, angleDisagreementDeg, options.MaxAngleDisagreementDeg)
+		return spotsGrid, err
+	}
 
 	var minX float64 = math.MaxFloat64
 	var maxX float64 = -math.MaxFloat64
@@ -246,17 +312,17 @@ func computeFullGrid(detectedGridNodes []GridNode) ([MMI_N_NODES]GridNode, error
 	var maxY float64 = -math.MaxFloat64
 
 	for _, gridNode := range detectedGridNodes {
-		minX = math.Min(minX, float64(gridNode.X))
-		maxX = math.Max(maxX, float64(gridNode.X))
+		minX = math.Min(minX, gridNode.X)
+		maxX = math.Max(maxX, gridNode.X)
 
-		minY = math.Min(minY, float64(gridNode.Y))
-		maxY = math.Max(maxY, float64(gridNode.Y))
+		minY = math.Min(minY, gridNode.Y)
+		maxY = math.Max(maxY, gridNode.Y)
 	}
 
 	// log.Println(minX, maxX, minY, maxY)
 
-	gridCenterX := int(minX + (maxX-minX)/2)
-	gridCenterY := int(minY + (maxY-minY)/2)
+	gridCenterX := minX + (maxX-minX)/2
+	gridCenterY := minY + (maxY-minY)/2
 
 	// log.Println("Grid center", gridCenterX, gridCenterY)
 
@@ -270,67 +336,171 @@ func computeFullGrid(detectedGridNodes []GridNode) ([MMI_N_NODES]GridNode, error
 		// log.Printf("Pivoted the ellipse. Before: %v; After: %v", ellipse.Center, pivotedEllipse.Center)
 	}
 
-	// Populate known grid projections on X and Y
-	// Use pivoted ones to robustify grid search
-	// Will unpivot back later
-	var pivotedX []float64
-	var pivotedY []float64
-	for _, pivotedGridNode := range pivotedGridNodes {
-		pivotedX = append(pivotedX, float64(pivotedGridNode.X))
-		pivotedY = append(pivotedY, float64(pivotedGridNode.Y))
-	}
+	diagnostics.LatticeFit = options.LatticeFit
+	var grid []GridNode
+	if options.LatticeFit == LATTICE_FIT_RANSAC {
+		// Lattice inferred from the contours lying on it, refined by the affine fit below
+		var inliers int
+		grid, inliers, err = inferLattice(detectedGridNodes, pivotedGridNodes, layout, diagnostics)
+		if err != nil {
+			return spotsGrid, fmt.Errorf("lattice inference: %w", err)
+		}
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Printf("Lattice inference: %d/%d contours on %d columns and %d rows", inliers, len(detectedGridNodes), diagnostics.BordersX, diagnostics.BordersY)
+		}
+	} else {
+		// Populate known grid projections on X and Y
+		// Use pivoted ones to robustify grid search
+		// Will unpivot back later
+		var pivotedX []float64
+		var pivotedY []float64
+		for _, pivotedGridNode := range pivotedGridNodes {
+			pivotedX = append(pivotedX, pivotedGridNode.X)
+			pivotedY = append(pivotedY, pivotedGridNode.Y)
+		}
 
-	// Calculate borders
-	ProjectionsX := computeBorders(pivotedX)
-	ProjectionsY := computeBorders(pivotedY)
+		// Calculate borders
+		ProjectionsX := computeBorders(pivotedX)
+		ProjectionsY := computeBorders(pivotedY)
 
-	if LOG_LEVEL <= INFO_LEVEL {
-		INFOLogger.Printf("X projected borders: %d; Y projected borders: %d", len(ProjectionsX), len(ProjectionsY))
-	}
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Printf("X projected borders: %d; Y projected borders: %d", len(ProjectionsX), len(ProjectionsY))
+		}
+		diagnostics.BordersX = len(ProjectionsX)
+		diagnostics.BordersY = len(ProjectionsY)
 
-	var n int
-	for i := 0; i < len(ProjectionsX); i++ {
-		var j int
-		// Alternating rows
-		if i%2 == 0 {
-			j = 1
+		if len(ProjectionsX) != layout.Cols || len(ProjectionsY) != layout.Rows {
+			err = fmt.Errorf("%d X and %d Y projected borders, chip layout %s has %d columns and %d rows", len(ProjectionsX), len(ProjectionsY), layout.Name, layout.Cols, layout.Rows)
+			return spotsGrid, err
 		}
-		for ; j < len(ProjectionsY); j += 2 {
-			var x = ProjectionsX[i]
-			var y = ProjectionsY[j]
+
+		// Nodes are indexed as the layout ones (col-major, interlaced rows)
+		grid = make([]GridNode, layout.MMINodes())
+		for n, layoutNode := range layout.Nodes {
+			var x = ProjectionsX[layoutNode.Col]
+			var y = ProjectionsY[layoutNode.Row]
 
 			unPivotedX, unPivotedY := pivot(
-				int(math.Round(x)),
-				int(math.Round(y)),
+				x,
+				y,
 				gridCenterX,
 				gridCenterY,
 				forwardEffectiveAngleRad,
 			)
 
-			node := GridNode{
+			grid[n] = GridNode{
 				X:   unPivotedX,
 				Y:   unPivotedY,
-				Row: j,
-				Col: i,
+				Row: layoutNode.Row,
+				Col: layoutNode.Col,
 			}
-			grid[n] = node
-			n++
 		}
 	}
-	return grid, err
+	spotsGrid.Nodes = grid
+	spotsGrid.AngleDeg = rad2Deg(forwardEffectiveAngleRad)
+	spotsGrid.CenterX = gridCenterX
+	spotsGrid.CenterY = gridCenterY
+
+	if options.LatticeFit != LATTICE_FIT_PROJECTION {
+		// Projection (or inferred) grid refined into an affine lattice
+		// The inferred grid lies close to the spots, the contours farther than
+		// MaxNodeResidual are left out (dust on a node missing its spot)
+		var maxDistance float64
+		if options.LatticeFit == LATTICE_FIT_RANSAC {
+			maxDistance = options.MaxNodeResidual
+		}
+		fit, err := fitLattice(detectedGridNodes, grid, options.LatticeFit == LATTICE_FIT_AFFINE_RADIAL, maxDistance)
+		if err != nil {
+			return spotsGrid, err
+		}
+		spotsGrid.CenterX, spotsGrid.CenterY = 0, 0
+		for n := range grid {
+			grid[n].X, grid[n].Y = fit.affine.Place(grid[n].Row, grid[n].Col)
+			spotsGrid.CenterX += grid[n].X / float64(len(grid))
+			spotsGrid.CenterY += grid[n].Y / float64(len(grid))
+		}
+		spotsGrid.AngleDeg = fit.affine.AngleDeg()
+		diagnostics.Affine = &fit.affine
+		diagnostics.FitNodes = fit.nodes
+		diagnostics.FitIterations = fit.iterations
+		diagnostics.FitResidualRMS = fit.residualRMS
+		diagnostics.FitResidualMax = fit.residualMax
+		if LOG_LEVEL <= INFO_LEVEL {
+			INFOLogger.Printf("Lattice fit (%s): %d contours, %d iterations, residual RMS: %.2f px, max: %.2f px, k1: %.4f",
+				options.LatticeFit, fit.nodes, fit.iterations, fit.residualRMS, fit.residualMax, fit.affine.RadialK1)
+		}
+	}
+	spotsGrid.Source = GRID_SOURCE_DETECTED
+	spotsGrid.Timestamp = int(time.Now().UnixMilli())
+
+	err = validateFullGrid(grid, detectedGridNodes, options, diagnostics)
+	spotsGrid.Metrics = GridMetrics{
+		DetectedNodes: diagnostics.DetectedNodes,
+		MatchedNodes:  diagnostics.MatchedNodes,
+		MeanResidual:  diagnostics.MeanResidual,
+	}
+	return spotsGrid, err
 }
 
-func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
+// validateFullGrid checks the fitted lattice against the detected nodes:
+// enough grid nodes must have a detected node (contour) within MaxNodeResidual.
+// Two grid nodes less than a pixel apart fail it too
+func validateFullGrid(grid []GridNode, detectedGridNodes []GridNode, options NodeDetectionOptions, diagnostics *GridDiagnostics) error {
+	diagnostics.NodeResiduals = make([]float64, len(grid))
+	diagnostics.MatchedNodes = 0
+	diagnostics.InferredNodes = nil
+	var residualAcc float64
+	for n, node := range grid {
+		for other := 0; other < n; other++ {
+			if math.Hypot(grid[other].X-node.X, grid[other].Y-node.Y) < 1 {
+				return fmt.Errorf("grid nodes %d [%d:%d] and %d [%d:%d] collapse at %.1f, %.1f",
+					other, grid[other].Row, grid[other].Col, n, node.Row, node.Col, node.X, node.Y)
+			}
+		}
 
-	var err error
-	gridNodes := make([]GridNode, 0)
+		residual := math.MaxFloat64
+		for _, detected := range detectedGridNodes {
+			residual = math.Min(residual, math.Hypot(detected.X-node.X, detected.Y-node.Y))
+		}
+		diagnostics.NodeResiduals[n] = residual
+		if residual <= options.MaxNodeResidual {
+			diagnostics.MatchedNodes++
+			residualAcc += residual
+			diagnostics.MaxResidual = math.Max(diagnostics.MaxResidual, residual)
+		} else {
+			diagnostics.InferredNodes = append(diagnostics.InferredNodes, n)
+		}
+	}
+	if diagnostics.MatchedNodes > 0 {
+		diagnostics.MeanResidual = residualAcc / float64(diagnostics.MatchedNodes)
+	}
 
-	if ok := gocv.IMWrite(filepath.Join(NODE_DETECTION_IMAGES_PATH, "original.bmp"), mat); !ok {
-		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Println("DetectPrimaryGridNodes: original.bmp imwrite nok")
+	// Contours off the lattice (e.g. dust, stray light)
+	diagnostics.UnmatchedContours = 0
+	for _, detected := range detectedGridNodes {
+		residual := math.MaxFloat64
+		for _, node := range grid {
+			residual = math.Min(residual, math.Hypot(detected.X-node.X, detected.Y-node.Y))
+		}
+		if residual > options.MaxNodeResidual {
+			diagnostics.UnmatchedContours++
 		}
 	}
 
+	if float64(diagnostics.MatchedNodes) < options.MinMatchedFraction*float64(len(grid)) {
+		return fmt.Errorf("%d/%d grid nodes within %.1f px of a detected contour, %.0f%% required",
+			diagnostics.MatchedNodes, len(grid), options.MaxNodeResidual, 100*options.MinMatchedFraction)
+	}
+	return nil
+}
+
+func detectPrimaryGridNodes(mat gocv.Mat, options NodeDetectionOptions, imagesPath string, radius int) ([]GridNode, error) {
+
+	var err error
+	gridNodes := make([]GridNode, 0)
+
+	writeDebugImage(imagesPath, "original.bmp", mat)
+
 	_min, _max, _, _ := gocv.MinMaxLoc(mat)
 	if LOG_LEVEL <= INFO_LEVEL {
 		INFOLogger.Println("DetectPrimaryGridNodes: mat min/max: ", _min, _max)
@@ -342,14 +512,10 @@ func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
 	gocv.Dilate(
 		mat,
 		&dilatedMat,
-		gocv.GetStructuringElement(gocv.MorphRect, image.Pt(NODE_DETECTION_DILATION_KERNEL_SIZE, NODE_DETECTION_DILATION_KERNEL_SIZE)),
+		gocv.GetStructuringElement(gocv.MorphRect, image.Pt(options.DilationKernelSize, options.DilationKernelSize)),
 	)
 
-	if ok := gocv.IMWrite(filepath.Join(NODE_DETECTION_IMAGES_PATH, "dilated_mat.bmp"), dilatedMat); !ok {
-		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Println("DetectPrimaryGridNodes: dilated_mat.bmp imwrite nok")
-		}
-	}
+	writeDebugImage(imagesPath, "dilated_mat.bmp", dilatedMat)
 
 	compareMat := gocv.NewMatWithSize(mat.Rows(), mat.Cols(), gocv.MatTypeCV8UC1)
 	defer compareMat.Close()
@@ -357,11 +523,7 @@ func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
 	gocv.Compare(mat, dilatedMat, &compareMat, gocv.CompareGE)
 	gocv.BitwiseNot(compareMat, &compareMat)
 
-	if ok := gocv.IMWrite(filepath.Join(NODE_DETECTION_IMAGES_PATH, "compare_mat.bmp"), compareMat); !ok {
-		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Println("DetectPrimaryGridNodes: compare_mat.bmp imwrite nok")
-		}
-	}
+	writeDebugImage(imagesPath, "compare_mat.bmp", compareMat)
 
 	// Detect Contours
 	contours := gocv.FindContours(compareMat, gocv.RetrievalTree, gocv.ChainApproxSimple)
@@ -369,28 +531,18 @@ func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
 		DEBUGLogger.Printf("Found %d contours", contours.Size())
 	}
 
-	if contours.Size() < NODE_DETECTION_MINIMUM_PRIMARY_CONTOURS {
-		err = fmt.Errorf("not enough contours detected: %d", contours.Size())
-		return gridNodes, err
-	}
-
-	thresholdedMatchResultWithEllipses := gocv.NewMatWithSize(mat.Rows(), mat.Cols(), gocv.MatTypeCV8UC1)
-	defer thresholdedMatchResultWithEllipses.Close()
-	compareMat.CopyTo(&thresholdedMatchResultWithEllipses)
-	gocv.CvtColor(thresholdedMatchResultWithEllipses, &thresholdedMatchResultWithEllipses, gocv.ColorGrayToBGRA)
-
 	var j int
 	for i := 0; i < contours.Size(); i++ {
 		contour := contours.At(i)
 		area := gocv.ContourArea(contour)
-		if area > float64(NODE_DETECTION_MAX_CONTOUR_AREA) || area < NODE_DETECTION_MIN_CONTOUR_AREA {
+		if area > options.MaxContourArea || area < options.MinContourArea {
 			continue
 		}
 		hull := gocv.NewMat()
 		gocv.ConvexHull(contour, &hull, true, true)
 		m := gocv.Moments(hull, true)
-		cX := int(m["m10"] / m["m00"])
-		cY := int(m["m01"] / m["m00"])
+		cX := m["m10"] / m["m00"]
+		cY := m["m01"] / m["m00"]
 		gridNodes = append(gridNodes, GridNode{
 			X: cX,
 			Y: cY,
@@ -398,23 +550,36 @@ func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
 		j++
 	}
 
+	if j < options.MinimumPrimaryContours {
+		err = fmt.Errorf("not enough contours within the area bounds: %d of %d detected", j, contours.Size())
+		return gridNodes, err
+	}
+
 	sort.SliceStable(gridNodes, func(i, j int) bool {
 		node1 := gridNodes[i]
 		node2 := gridNodes[j]
 
-		if node2.X < node1.X-NODE_DETECTION_NODE_INTERLACE_GAP || node2.X > node1.X+NODE_DETECTION_NODE_INTERLACE_GAP {
+		interlaceGap := float64(options.NodeInterlaceGap)
+		if node2.X < node1.X-interlaceGap || node2.X > node1.X+interlaceGap {
 			return node1.X < node2.X
 		} else {
 			return node1.Y < node2.Y
 		}
 	})
 
+	if imagesPath == "" {
+		return gridNodes, err
+	}
+	thresholdedMatchResultWithEllipses := gocv.NewMatWithSize(mat.Rows(), mat.Cols(), gocv.MatTypeCV8UC1)
+	defer thresholdedMatchResultWithEllipses.Close()
+	compareMat.CopyTo(&thresholdedMatchResultWithEllipses)
+	gocv.CvtColor(thresholdedMatchResultWithEllipses, &thresholdedMatchResultWithEllipses, gocv.ColorGrayToBGRA)
 	for i, gridNode := range gridNodes {
-		gocv.Ellipse(&thresholdedMatchResultWithEllipses, image.Pt(gridNode.X, gridNode.Y), image.Pt(MMI_EXTRACTION_ELLIPSE_RADIUS, MMI_EXTRACTION_ELLIPSE_RADIUS), 0, 0, 360, color.RGBA{R: 0, G: 0, B: 255, A: 127}, 2)
+		gocv.EllipseWithParams(&thresholdedMatchResultWithEllipses, subPixelPt(gridNode.X, gridNode.Y), image.Pt(radius<<DRAWING_SHIFT, radius<<DRAWING_SHIFT), 0, 0, 360, color.RGBA{R: 0, G: 0, B: 255, A: 127}, 2, gocv.LineAA, DRAWING_SHIFT)
 		gocv.PutText(
 			&thresholdedMatchResultWithEllipses,
 			fmt.Sprint(i),
-			image.Pt(gridNode.X+5, gridNode.Y-5),
+			pixelPt(gridNode.X+5, gridNode.Y-5),
 			gocv.FontHersheyPlain,
 			1,
 			color.RGBA{R: 255, G: 0, B: 0, A: 255},
@@ -422,46 +587,96 @@ func detectPrimaryGridNodes(mat gocv.Mat) ([]GridNode, error) {
 		)
 	}
 
-	if ok := gocv.IMWrite(filepath.Join(NODE_DETECTION_IMAGES_PATH, "thresholded_matching_result_with_detected_ellipses.bmp"), thresholdedMatchResultWithEllipses); !ok {
+	writeDebugImage(imagesPath, "thresholded_matching_result_with_detected_ellipses.bmp", thresholdedMatchResultWithEllipses)
+	return gridNodes, err
+}
+
+// writeDebugImage writes the grid detection debug image, unless imagesPath is empty
+func writeDebugImage(imagesPath string, name string, mat gocv.Mat) {
+	if imagesPath == "" {
+		return
+	}
+	if ok := gocv.IMWrite(filepath.Join(imagesPath, name), mat); !ok {
 		if LOG_LEVEL <= WARNING_LEVEL {
-			WARNINGLogger.Println("DetectPrimaryGridNodes: thresholded_matching_result_with_detected_ellipses.bmp imwrite nok")
+			WARNINGLogger.Printf("DetectPrimaryGridNodes: %s imwrite nok", name)
 		}
 	}
-	return gridNodes, err
 }
 
-func CalibrateSpotsGrid(mat gocv.Mat) ([MMI_N_NODES]GridNode, error) {
+// CalibrateSpotsGrid detects the MMI spots grid of the chip layout on mat.
+// Debug images are written to imagesPath (none if empty), with the extraction windows of radius
+func CalibrateSpotsGrid(mat gocv.Mat, layout *ChipLayout, options NodeDetectionOptions, imagesPath string, radius int) ([]GridNode, error) {
+	spotsGrid, _, err := DetectSpotsGrid(mat, layout, options, imagesPath, radius)
+	return spotsGrid.Nodes, err
+}
+
+// DetectSpotsGrid is CalibrateSpotsGrid also returning the grid geometry,
+// and the detection diagnostics whatever the outcome
+func DetectSpotsGrid(mat gocv.Mat, layout *ChipLayout, options NodeDetectionOptions, imagesPath string, radius int) (SpotsGridMessage, GridDiagnostics, error) {
 	var err error
-	var gridNodes [MMI_N_NODES]GridNode
+	var spotsGrid SpotsGridMessage
+	start := time.Now()
+	diagnostics := GridDiagnostics{
+		ExpectedNodes: layout.MMINodes(),
+		Timestamp:     int(start.UnixMilli()),
+	}
 
-	primaryGridNodes, err := detectPrimaryGridNodes(mat)
-	if err != nil {
-		return gridNodes, err
+	primaryGridNodes, err := detectPrimaryGridNodes(mat, options, imagesPath, radius)
+	diagnostics.ContoursMs = float64(time.Since(start).Microseconds()) / 1000
+	if err == nil {
+		spotsGrid, err = computeFullGrid(primaryGridNodes, layout, options, &diagnostics)
+	}
+	diagnostics.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Grid detection took %.1f ms: contours %.1f ms, angle search %.1f ms",
+			diagnostics.DurationMs, diagnostics.ContoursMs, diagnostics.AngleSearchMs)
 	}
-	gridNodes, err = computeFullGrid(primaryGridNodes)
 	if err != nil {
-		return gridNodes, err
+		diagnostics.Error = err.Error()
+		return spotsGrid, diagnostics, err
 	}
-	NODE_DETECTION_EFFECTIVE_GRID = gridNodes
-	return gridNodes, err
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("Grid detected. Matched nodes: %d/%d (%d inferred), mean residual: %.2f px, max: %.2f px, contours off the grid: %d",
+			diagnostics.MatchedNodes, diagnostics.ExpectedNodes, len(diagnostics.InferredNodes), diagnostics.MeanResidual, diagnostics.MaxResidual, diagnostics.UnmatchedContours)
+	}
+	return spotsGrid, diagnostics, err
 }
 
-func SaveSpotsgrid(grid [MMI_N_NODES]GridNode) {
-	// f, err := os.Create(fmt.Sprintf("%d.spotsgrid.csv", time.Now().UnixMilli()))
-	f, err := os.Create("spotsgrid.csv")
+// BenchSpotsGrid times runs grid detections of the grayscale image at imagePath
+// with the options node detection and chip layout, e.g. to tune the angle search on the target.
+// No debug images are written, not to time the disk
+func BenchSpotsGrid(imagePath string, runs int, options DriverOptions) error {
+	if runs <= 0 {
+		return fmt.Errorf("runs must be positive: %d", runs)
+	}
+	layout, err := LoadChipLayout(options.ChipLayout)
 	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-	csvW := csv.NewWriter(f)
-	csvW.Write([]string{"row", "col", "x", "y"})
-	for _, node := range grid {
-		csvW.Write([]string{
-			fmt.Sprint(node.Row),
-			fmt.Sprint(node.Col),
-			fmt.Sprint(node.X),
-			fmt.Sprint(node.Y),
-		})
+		return err
+	}
+	mat := gocv.IMRead(imagePath, gocv.IMReadGrayScale)
+	if mat.Empty() {
+		return fmt.Errorf("could not read image: %s", imagePath)
+	}
+	defer mat.Close()
+
+	var durationAcc, contoursAcc, angleSearchAcc float64
+	minDuration := math.MaxFloat64
+	var maxDuration float64
+	var diagnostics GridDiagnostics
+	for run := 0; run < runs; run++ {
+		_, diagnostics, err = DetectSpotsGrid(mat, layout, options.NodeDetection, "", options.Extraction.EllipseRadius)
+		if err != nil {
+			return fmt.Errorf("run %d: %w", run, err)
+		}
+		durationAcc += diagnostics.DurationMs
+		contoursAcc += diagnostics.ContoursMs
+		angleSearchAcc += diagnostics.AngleSearchMs
+		minDuration = math.Min(minDuration, diagnostics.DurationMs)
+		maxDuration = math.Max(maxDuration, diagnostics.DurationMs)
+	}
+	if LOG_LEVEL <= INFO_LEVEL {
+		INFOLogger.Printf("BenchSpotsGrid: %d runs on %s (%d contours, angle %.3f deg). Detection: mean %.1f ms, min %.1f ms, max %.1f ms; contours: mean %.1f ms; angle search: mean %.1f ms",
+			runs, imagePath, diagnostics.DetectedNodes, diagnostics.AngleDeg, durationAcc/float64(runs), minDuration, maxDuration, contoursAcc/float64(runs), angleSearchAcc/float64(runs))
 	}
-	csvW.Flush()
+	return nil
 }
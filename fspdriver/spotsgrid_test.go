@@ -0,0 +1,137 @@
+package fspdriver
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// syntheticAffine maps the layout onto a lattice of 38 px columns and 17 px rows, rotated by angleDeg
+func syntheticAffine(angleDeg float64) GridAffine {
+	angleRad := deg2Rad(angleDeg)
+	return GridAffine{
+		X0:   120,
+		XCol: 38 * math.Cos(angleRad),
+		XRow: -17 * math.Sin(angleRad),
+		Y0:   60,
+		YCol: 38 * math.Sin(angleRad),
+		YRow: 17 * math.Cos(angleRad),
+	}
+}
+
+// placeSyntheticGrid places the nodes of the chip layout, as detected contours,
+// with the affine map and a centroid noise of standard deviation noise
+func placeSyntheticGrid(layout *ChipLayout, affine GridAffine, noise float64) []GridNode {
+	rng := rand.New(rand.NewSource(1))
+	nodes := make([]GridNode, len(layout.Nodes))
+	for n, layoutNode := range layout.Nodes {
+		x, y := affine.Place(layoutNode.Row, layoutNode.Col)
+		nodes[n] = GridNode{
+			X: x + rng.NormFloat64()*noise,
+			Y: y + rng.NormFloat64()*noise,
+		}
+	}
+	return nodes
+}
+
+// syntheticGridNodes places the nodes of the chip layout, as detected contours,
+// on a lattice rotated by angleDeg, with centroid noise
+func syntheticGridNodes(layout *ChipLayout, angleDeg float64) []GridNode {
+	return placeSyntheticGrid(layout, syntheticAffine(angleDeg), 0.3)
+}
+
+// setLogLevel sets LOG_LEVEL for the test, restored on cleanup
+func setLogLevel(tb testing.TB, level int) {
+	logLevel := LOG_LEVEL
+	LOG_LEVEL = level
+	tb.Cleanup(func() {
+		LOG_LEVEL = logLevel
+	})
+}
+
+// linearCommonAngleRad is the linear sweep findCommonAngleRad replaced,
+// kept as the reference of BenchmarkFindCommonAngleRad
+func linearCommonAngleRad(aroundAngleRad float64, angleToSweepRad float64, angleStepRad float64, gridNodes []GridNode) float64 {
+	var commonAngle float64
+	var angleStepsInt int = int(math.Round(angleToSweepRad / angleStepRad))
+	var commonAngleEnergy float64 = 0
+	for angleIdx := -angleStepsInt; angleIdx < angleStepsInt; angleIdx++ {
+		var min float64 = math.MaxFloat64
+		var max float64 = -math.MaxFloat64
+		theta := aroundAngleRad + float64(angleIdx)*angleStepRad
+		var rs []float64
+		for _, gridNode := range gridNodes {
+			r := gridNode.X*math.Cos(theta) + gridNode.Y*math.Sin(theta)
+			min = math.Min(min, r)
+			max = math.Max(max, r)
+			rs = append(rs, r)
+		}
+		step := (max - min) / 90
+		binWidth := step / 3
+		var binEnergySum float64 = 0
+		for bin := min; bin < max; bin += binWidth {
+			var binPopulation float64 = 0
+			for _, r := range rs {
+				if bin <= r && r < bin+step {
+					binPopulation++
+				}
+			}
+			binEnergySum += math.Pow(binPopulation, 4)
+		}
+		if binEnergySum > commonAngleEnergy {
+			commonAngle = theta
+			commonAngleEnergy = binEnergySum
+		}
+	}
+	return commonAngle
+}
+
+func BenchmarkFindCommonAngleRad(b *testing.B) {
+	layout, err := LoadChipLayout(CHIP_LAYOUT)
+	if err != nil {
+		b.Fatal(err)
+	}
+	nodes := syntheticGridNodes(layout, 1.2)
+	options := DefaultDriverOptions().NodeDetection
+
+	b.Run("coarse-to-fine", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			findCommonAngleRad(
+				0,
+				deg2Rad(options.CommonAngleSearchArcDeg),
+				deg2Rad(options.CommonAngleSearchStepDeg),
+				deg2Rad(options.CommonAngleSearchPrecisionDeg),
+				options.CommonAngleSearchBins,
+				nodes,
+			)
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearCommonAngleRad(0, deg2Rad(options.CommonAngleSearchArcDeg), deg2Rad(0.1), nodes)
+		}
+	})
+}
+
+func BenchmarkComputeFullGrid(b *testing.B) {
+	layout, err := LoadChipLayout(CHIP_LAYOUT)
+	if err != nil {
+		b.Fatal(err)
+	}
+	nodes := syntheticGridNodes(layout, 1.2)
+	setLogLevel(b, ERROR_LEVEL)
+
+	for _, latticeFit := range LATTICE_FITS {
+		options := DefaultDriverOptions().NodeDetection
+		options.LatticeFit = latticeFit
+		b.Run(latticeFit, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var diagnostics GridDiagnostics
+				_, err := computeFullGrid(nodes, layout, options, &diagnostics)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
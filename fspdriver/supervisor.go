@@ -0,0 +1,215 @@
+package fspdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Restart backoff doubles after each failed attempt, up to the max
+	SUPERVISOR_INITIAL_BACKOFF = 1 * time.Second
+	SUPERVISOR_MAX_BACKOFF     = 1 * time.Minute
+	// Backoff is reset once the camera ran this long without failure
+	SUPERVISOR_BACKOFF_RESET_PERIOD = 5 * time.Minute
+
+	// Camera is considered stalled when no frame arrived for this long
+	SUPERVISOR_STALL_TIMEOUT        = 5 * time.Second
+	SUPERVISOR_STALL_CHECK_INTERVAL = 1 * time.Second
+)
+
+const (
+	SUPERVISOR_EVENT_STARTED    = "started"
+	SUPERVISOR_EVENT_FAILED     = "failed"
+	SUPERVISOR_EVENT_RESTARTING = "restarting"
+	SUPERVISOR_EVENT_FINISHED   = "finished"
+	SUPERVISOR_EVENT_STOPPED    = "stopped"
+)
+
+var (
+	errCameraStalled = errors.New("camera stalled")
+)
+
+// monitoredFrameSource keeps track of the
+// wall-clock time of the last frame received
+type monitoredFrameSource struct {
+	FrameSource
+	lastFrameNano int64
+}
+
+func (s *monitoredFrameSource) NextFrame() ([]byte, time.Time, error) {
+	buf, ts, err := s.FrameSource.NextFrame()
+	if err == nil {
+		atomic.StoreInt64(&s.lastFrameNano, time.Now().UnixNano())
+	}
+	return buf, ts, err
+}
+
+func (s *monitoredFrameSource) Unwrap() FrameSource {
+	return s.FrameSource
+}
+
+func (s *monitoredFrameSource) sinceLastFrame() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastFrameNano)))
+}
+
+// respawningFrameSource is implemented by the frame sources which restart
+// their acquisition on their own, e.g. on exposure changes.
+// Stall detection is paused while Respawning
+type respawningFrameSource interface {
+	Respawning() bool
+}
+
+// unwrapFrameSource returns the source wrapped by the supervisor,
+// for its optional interfaces (GroundTruthSource, ExposureController) to be found
+func unwrapFrameSource(source FrameSource) FrameSource {
+	wrapper, ok := source.(interface{ Unwrap() FrameSource })
+	if !ok {
+		return source
+	}
+	return wrapper.Unwrap()
+}
+
+func (d *Driver) publishSupervisorEvent(event string, restarts int, err error) {
+	msg := SupervisorMessage{
+		Event:    event,
+		State:    d.getCameraState(),
+		Restarts: restarts,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	topic := d.getFullTopicString(CAMERA_SUPERVISOR_BROADCAST_MQTT_TOPIC_PATH)
+	pubErr := PublishJsonMsg(topic, msg, d.client)
+	if pubErr != nil {
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Error occurred while publishing supervisor event: %s", pubErr.Error())
+		}
+	}
+}
+
+// SuperviseCamera runs MainLoop on the started source and restarts the camera
+// with exponential backoff whenever the loop fails (process exit, EOF, stall).
+// Restarts re-apply the last calibration (shutter speed, grid, dark value).
+// Returns once ctx is cancelled or the source reached its end
+func (d *Driver) SuperviseCamera(ctx context.Context, source FrameSource) {
+	var restarts int
+	backoff := SUPERVISOR_INITIAL_BACKOFF
+
+	for {
+		monitoredSource := &monitoredFrameSource{
+			FrameSource:   source,
+			lastFrameNano: time.Now().UnixNano(),
+		}
+		runTs := time.Now()
+		d.publishSupervisorEvent(SUPERVISOR_EVENT_STARTED, restarts, nil)
+
+		loopErrChan := make(chan error, 1)
+		go func() {
+			loopErrChan <- d.MainLoop(ctx, monitoredSource)
+		}()
+
+		loopReturned, err := watchMainLoop(ctx, monitoredSource, loopErrChan)
+		StopCamera(source)
+		if !loopReturned {
+			// Stopping the camera unblocks the pending read
+			<-loopErrChan
+		}
+		if err == nil {
+			d.publishSupervisorEvent(SUPERVISOR_EVENT_STOPPED, restarts, nil)
+			return
+		}
+		if errors.Is(err, ErrEndOfStream) {
+			if LOG_LEVEL <= INFO_LEVEL {
+				INFOLogger.Println("Frame source reached its end")
+			}
+			d.publishSupervisorEvent(SUPERVISOR_EVENT_FINISHED, restarts, nil)
+			return
+		}
+
+		if LOG_LEVEL <= ERROR_LEVEL {
+			ERRORLogger.Printf("Camera failed: %s", err.Error())
+		}
+		d.setCameraState(CAMERA_STATE_ERROR, err.Error())
+		d.publishSupervisorEvent(SUPERVISOR_EVENT_FAILED, restarts, err)
+		if time.Since(runTs) > SUPERVISOR_BACKOFF_RESET_PERIOD {
+			backoff = SUPERVISOR_INITIAL_BACKOFF
+		}
+
+		// Restart until it succeeds or is stopped
+		for {
+			if LOG_LEVEL <= WARNING_LEVEL {
+				WARNINGLogger.Printf("Restarting camera in %s. Restarts so far: %d", backoff.String(), restarts)
+			}
+			d.publishSupervisorEvent(SUPERVISOR_EVENT_RESTARTING, restarts, nil)
+			select {
+			case <-ctx.Done():
+				d.publishSupervisorEvent(SUPERVISOR_EVENT_STOPPED, restarts, nil)
+				return
+			case <-time.After(backoff):
+			}
+			restarts++
+			backoff *= 2
+			if backoff > SUPERVISOR_MAX_BACKOFF {
+				backoff = SUPERVISOR_MAX_BACKOFF
+			}
+
+			err = d.transitionCameraStateFrom([]CameraState{CAMERA_STATE_ERROR}, CAMERA_STATE_STARTING, fmt.Sprintf("restart %d", restarts))
+			if err != nil {
+				// Camera is being stopped
+				<-ctx.Done()
+				d.publishSupervisorEvent(SUPERVISOR_EVENT_STOPPED, restarts, nil)
+				return
+			}
+			calibration := d.getCalibration()
+			source, err = d.StartCamera(d.getFramerate(), calibration.EffectiveShutterSpeed, calibration.EffectiveGain)
+			if err == nil {
+				if LOG_LEVEL <= INFO_LEVEL {
+					INFOLogger.Printf("Camera restarted with last calibration. ShutterSpeed: %d, DarkValue: %d", calibration.EffectiveShutterSpeed, calibration.EffectiveDarkValue)
+				}
+				d.setCameraState(CAMERA_STATE_RUNNING, "")
+				break
+			}
+			if LOG_LEVEL <= ERROR_LEVEL {
+				ERRORLogger.Printf("Camera restart failed: %s", err.Error())
+			}
+			d.setCameraState(CAMERA_STATE_ERROR, err.Error())
+			d.publishSupervisorEvent(SUPERVISOR_EVENT_FAILED, restarts, err)
+		}
+	}
+}
+
+// watchMainLoop blocks until MainLoop fails, stalls or ctx is cancelled.
+// Returns whether MainLoop has returned, and the error, nil on cancellation
+func watchMainLoop(ctx context.Context, source *monitoredFrameSource, loopErrChan chan error) (bool, error) {
+	ticker := time.NewTicker(SUPERVISOR_STALL_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case err := <-loopErrChan:
+			if ctx.Err() != nil {
+				// MainLoop returned because of the cancellation
+				return true, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("main loop returned")
+			}
+			return true, err
+		case <-ticker.C:
+			if respawning, ok := source.FrameSource.(respawningFrameSource); ok && respawning.Respawning() {
+				// Counted from the end of the respawn
+				atomic.StoreInt64(&source.lastFrameNano, time.Now().UnixNano())
+				continue
+			}
+			sinceLastFrame := source.sinceLastFrame()
+			if sinceLastFrame > SUPERVISOR_STALL_TIMEOUT {
+				return false, fmt.Errorf("%w: no frame for %s", errCameraStalled, sinceLastFrame.String())
+			}
+		}
+	}
+}
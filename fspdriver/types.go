@@ -1,22 +1,145 @@
 package fspdriver
 
+// GridNode is a MMI spot center, sub-pixel, pixel centers lying on integer coordinates
 type GridNode struct {
-	X   int
-	Y   int
+	X   float64
+	Y   float64
 	Row int
 	Col int
 }
 
+// GridGeometry is how the spots grid lies on the image,
+// and how it was obtained
+type GridGeometry struct {
+	AngleDeg float64
+	CenterX  float64
+	CenterY  float64
+	// One of GRID_SOURCE_
+	Source    string
+	Metrics   GridMetrics
+	Timestamp int
+}
+
+type GridMetrics struct {
+	// Contours the grid was computed from, detection only
+	DetectedNodes int
+	// Nodes with a contour (detection) or a spot (refinement) nearby,
+	// and their mean residual (px). Shift of the stored grid, refinement only
+	MatchedNodes int
+	ShiftX       float64
+	ShiftY       float64
+	MeanResidual float64
+}
+
+// GridDiagnostics report how well the detected contours fit
+// the chip layout lattice, published on each grid detection
+type GridDiagnostics struct {
+	Timestamp int
+	// Contours kept, and chip layout MMIs
+	DetectedNodes int
+	ExpectedNodes int
+	// Projected borders found, and chip layout columns and rows
+	BordersX         int
+	BordersY         int
+	ExpectedBordersX int
+	ExpectedBordersY int
+	// Angles of the horizontal and vertical grid lines, and effective one
+	HorizontalAngleDeg float64
+	VerticalAngleDeg   float64
+	AngleDeg           float64
+	// Distance (px) of each grid node to the nearest contour, indexed as the grid
+	NodeResiduals []float64
+	// Nodes within NodeDetectionOptions.MaxNodeResidual of a contour, and their residuals
+	MatchedNodes int
+	MeanResidual float64
+	MaxResidual  float64
+	// Grid indices of the other nodes, placed by the lattice only
+	InferredNodes []int
+	// Contours farther than MaxNodeResidual from any node
+	UnmatchedContours int
+	// One of LATTICE_FITS. The affine ones report the fitted map, the contours
+	// assigned to a node it was fitted on and their residuals (px) to the fitted nodes
+	LatticeFit     string
+	Affine         *GridAffine `json:",omitempty"`
+	FitNodes       int
+	FitIterations  int
+	FitResidualRMS float64
+	FitResidualMax float64
+	// Detection time (ms), of which contour detection (including the debug
+	// images, if written) and common angle search
+	DurationMs    float64
+	ContoursMs    float64
+	AngleSearchMs float64
+	// RANSAC lattice fit: placements of the lattice within the layout matching as many
+	// contours, more than 1 when border columns or rows have no contours
+	PlacementCandidates int
+	// Why the detection failed, if it did
+	Error string
+}
+
+// SpotsGridMessage is the spots grid as persisted, see gridstore.go
+type SpotsGridMessage struct {
+	ChipLayout string
+	Nodes      []GridNode
+	GridGeometry
+}
+
 type Frame struct {
 	I         int
 	Timestamp int
 	Values    []float64
+	// Exposure was adjusted by the ExposureTracker
+	// within the frame (or the accumulated frames)
+	ExposureChanged bool
+	// Union of the QUALITY_ flags of the MMIs within the frame (or the accumulated frames)
+	Quality uint32
+	// Per MMI peak values and shares of clipped pixels, MMI frames only
+	Peaks      []int     `json:",omitempty"`
+	Saturation []float64 `json:",omitempty"`
+}
+
+// GridDriftMessage is published on each GridTracker estimate
+type GridDriftMessage struct {
+	I         int
+	Timestamp int
+	// Smoothed correction of the calibrated grid:
+	// rotation around its center, then shift (px)
+	ShiftX      float64
+	ShiftY      float64
+	RotationDeg float64
+	// Estimate of the interval, zero if too few spots were found
+	MeasuredShiftX      float64
+	MeasuredShiftY      float64
+	MeasuredRotationDeg float64
+	MatchedNodes        int
+	MeanResidual        float64
+	// Max node displacement (px) by this update, applied from the next frame on
+	MaxNodeShift float64
+}
+
+type QualityAlertMessage struct {
+	I         int
+	Timestamp int
+	// Compromised MZIs, none once the alert is cleared
+	MZIs []MZIQualityAlert
+}
+
+type MZIQualityAlert struct {
+	MZI int
+	// Chip layout label, e.g. "P0"
+	Label   string
+	Quality uint32
+	// MMI indices (c, b, a, as ChipLayout.MZIMMIIndices) and their flags
+	MMIs       [3]int
+	MMIQuality [3]uint32
 }
 
 type CameraState byte
 
 type CameraStateMessage struct {
-	State CameraState
+	State  CameraState
+	Name   string
+	Reason string
 }
 
 type CameraFramerateMessage struct {
@@ -24,9 +147,98 @@ type CameraFramerateMessage struct {
 }
 
 type CameraCalibrationMessage struct {
+	// Value measured by the AEC strategy and its target
+	AECStrategy           string
 	TargetMaxValue        int
 	EffectiveMaxValue     int
 	EffectiveShutterSpeed int
+	EffectiveGain         float64
 	EffectiveDarkValue    byte
-	EffectiveGrid         [MMI_N_NODES]GridNode
+	EffectiveGrid         []GridNode
+	EffectiveGridGeometry GridGeometry
+	// Shutter speed and gain pinned with /camera/exposure/set, AEC bypassed
+	ManualExposure bool
+	// Spot level the ExposureTracker holds the exposure at
+	ReferenceSpotLevel float64
+	// Luma dark frame subtracted before extraction, if any.
+	// Only its mean and the exposure it was acquired at are reported
+	DarkFrame             []byte `json:"-"`
+	DarkFrameMean         float64
+	DarkFrameShutterSpeed int
+	DarkFrameGain         float64
+	// Name of the chip layout the grid is indexed after
+	ChipLayout string
+	// Per MMI gains correcting the illumination non-uniformity, see flatfield.go.
+	// No correction if empty
+	FlatFieldGains []float64
+}
+
+type CalibrationRequestMessage struct {
+	// Among CALIBRATION_STEPS, CALIBRATION_DEFAULT_STEPS if empty
+	Steps []string
+	// User supplied dark frame image for the dark_frame step,
+	// acquired from the camera if empty
+	DarkFramePath string
+	// Likewise, reference image for the flat_field step
+	FlatFieldPath string
+}
+
+type FlatFieldMessage struct {
+	// Gains of the chip layout MMIs, indexed as the grid. Empty clears the correction
+	Gains []float64
+}
+
+type ExposureMessage struct {
+	Manual       bool
+	ShutterSpeed int
+	Gain         float64
+}
+
+// GridSetMessage sets the grid manually, from either all the Nodes
+// (indexed as the chip layout ones), a Lattice, or a shift and rotation
+// of the current grid. Manual false releases the manual grid
+type GridSetMessage struct {
+	Manual      bool
+	Nodes       []GridNode
+	Lattice     *GridLattice
+	ShiftX      float64
+	ShiftY      float64
+	RotationDeg float64
+}
+
+// GridLattice places the chip layout grid: node [row, col] lies at
+// Origin + (col*PitchX, row*PitchY), rotated by AngleDeg around Origin
+type GridLattice struct {
+	OriginX  float64
+	OriginY  float64
+	PitchX   float64
+	PitchY   float64
+	AngleDeg float64
+}
+
+type RecordingMessage struct {
+	Recording bool
+	Path      string
+	Frames    int
+}
+
+type SupervisorMessage struct {
+	Event    string
+	State    CameraState
+	Restarts int
+	Error    string
+}
+
+type AvailabilityMessage struct {
+	Status string
+}
+
+type ConfigValue struct {
+	Key    string
+	Value  interface{}
+	Source string
+}
+
+type ConfigMessage struct {
+	Values []ConfigValue
 }
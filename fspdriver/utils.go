@@ -2,6 +2,6 @@ package fspdriver
 
 import "fmt"
 
-func getFullTopicString(relativePath string) string {
-	return fmt.Sprintf("/seone/%s%s", SEONE_SN, relativePath)
+func (d *Driver) getFullTopicString(relativePath string) string {
+	return fmt.Sprintf("/seone/%s%s", d.options.SerialNumber, relativePath)
 }
@@ -5,10 +5,12 @@ go 1.19
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	gocv.io/x/gocv v0.31.0 // important 0.31.0 (opencv 4.6)
-
 )
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/google/uuid v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"go-seone-camera-driver/fspdriver"
 )
 
 const (
+	DEFAULT_CONFIG_PATH = "config/config.yaml"
+
 	USAGE = `
 	Usage: %s
 	Libcamera-powered Camera Driver for Seone. Broadcasts MMI/MZI values extracted from camera feed to MQTT broker.
@@ -20,8 +25,34 @@ const (
 
 func main() {
 
-	serialNumberPathPtr := flag.String("s", "config/serialnumber.txt", "path to serialnumber txt file")
-	imagesPath := flag.String("a", "images", "tcp binding addr")
+	if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
+		err := fspdriver.SetLogLevel(logLevel)
+		if err != nil {
+			fspdriver.WARNINGLogger.Println(err)
+		}
+	}
+
+	defaults := fspdriver.DefaultDriverOptions()
+
+	configPath := flag.String("c", DEFAULT_CONFIG_PATH, "path to the YAML config file")
+	serialNumberPathPtr := flag.String("s", "config/serialnumber.txt", "path to serialnumber txt file, used unless serial_number is configured")
+	flag.String("a", defaults.ImagesPath, "path to the grid detection debug images directory")
+	flag.String("source", defaults.FrameSource, "frame source to acquire from: libcamera, simulator, replay")
+	simulatorConfigPath := flag.String("simulator-config", "", "path to simulator config file (yaml or json)")
+	flag.Bool("record", defaults.RecordOnStart, "record raw frames into a session file once the camera is started")
+	flag.String("recordings", defaults.RecordingsPath, "path to the recorded session files directory")
+	replayPath := flag.String("replay", defaults.ReplayPath, "path to a recorded session file to replay (implies -source replay)")
+	flag.Float64("replay-speed", defaults.ReplaySpeed, "replay speed relative to the recording, 0 for as fast as possible")
+	benchGridPath := flag.String("bench-grid", "", "time the spots grid detection of a grayscale image and exit")
+	benchRuns := flag.Int("bench-runs", 10, "grid detections timed by -bench-grid")
+	var overrides []string
+	flag.Func("set", "override a config value, e.g. -set aec.max_value_target=140 (repeatable)", func(s string) error {
+		if !strings.Contains(s, "=") {
+			return fmt.Errorf("expected key=value: %s", s)
+		}
+		overrides = append(overrides, s)
+		return nil
+	})
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), USAGE, os.Args[0])
@@ -29,31 +60,101 @@ func main() {
 	}
 	flag.Parse()
 
-	if serialNumberPathPtr != nil {
-		fspdriver.SEONE_SN_PATH = *serialNumberPathPtr
-	}
-	fspdriver.InitSerialNumber()
+	explicitFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
 
-	if imagesPath != nil {
-		fspdriver.NODE_DETECTION_IMAGES_PATH = *imagesPath
+	// Defaults < config file < env variables < flags
+	options := defaults
+	_, err := os.Stat(*configPath)
+	if err == nil || explicitFlags["c"] {
+		options, err = fspdriver.LoadConfigFile(*configPath)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+	} else if fspdriver.LOG_LEVEL <= fspdriver.INFO_LEVEL {
+		fspdriver.INFOLogger.Printf("No config file at %s, using the defaults", *configPath)
+	}
+	err = options.ApplyEnv()
+	if err != nil {
+		fspdriver.ERRORLogger.Fatal(err)
 	}
-	fspdriver.InitImagesPath()
 
+	// Flags mapped onto config keys, applied only when set explicitly
+	flagKeys := map[string]string{
+		"a":            "images_path",
+		"source":       "frame_source",
+		"record":       "record_on_start",
+		"recordings":   "recordings_path",
+		"replay":       "replay_path",
+		"replay-speed": "replay_speed",
+	}
+	for name, key := range flagKeys {
+		if !explicitFlags[name] {
+			continue
+		}
+		err = options.Set(key, flag.Lookup(name).Value.String(), fspdriver.CONFIG_SOURCE_FLAG)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+	}
+	if *simulatorConfigPath != "" {
+		options.SimulatorConfig, err = fspdriver.LoadSimulatorConfig(*simulatorConfigPath)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+		options.SetSource("simulator", fspdriver.CONFIG_SOURCE_FLAG)
+	}
+	if explicitFlags["replay"] && *replayPath != "" {
+		options.FrameSource = fspdriver.FRAME_SOURCE_REPLAY
+		options.SetSource("frame_source", fspdriver.CONFIG_SOURCE_FLAG)
+	}
+	for _, override := range overrides {
+		kv := strings.SplitN(override, "=", 2)
+		err = options.Set(kv[0], kv[1], fspdriver.CONFIG_SOURCE_FLAG)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+	}
 
+	if *benchGridPath != "" {
+		err = fspdriver.BenchSpotsGrid(*benchGridPath, *benchRuns, options)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+		return
+	}
 
-	var stateChan chan fspdriver.CameraState = make(chan fspdriver.CameraState, 1)
-	var imageTriggerChan chan bool = make(chan bool, 1)
+	if options.SerialNumber == "" {
+		options.SerialNumber, err = fspdriver.ReadSerialNumber(*serialNumberPathPtr)
+		if err != nil {
+			fspdriver.ERRORLogger.Fatal(err)
+		}
+		options.SetSource("serial_number", fspdriver.CONFIG_SOURCE_FILE)
+	}
 
-	client, err := fspdriver.NewMQTTClient()
+	driver, err := fspdriver.NewDriver(options)
 	if err != nil {
 		fspdriver.ERRORLogger.Fatal(err)
 	}
 
-	fspdriver.SetupMQTTSubscriptionCallbacks(stateChan, imageTriggerChan, client)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	go fspdriver.CameraPipeAndLoop(stateChan, imageTriggerChan, client)
+	err = driver.Start(ctx)
+	if err != nil {
+		fspdriver.ERRORLogger.Println(err)
+		driver.Stop()
+		os.Exit(1)
+	}
 
-	for {
-		time.Sleep(1 * time.Second)
+	// Block until signal is received
+	<-ctx.Done()
+	fspdriver.WARNINGLogger.Println("Received SIGNAL, shutting down")
+
+	err = driver.Stop()
+	if err != nil {
+		fspdriver.ERRORLogger.Println(err)
 	}
 }